@@ -0,0 +1,207 @@
+package mcumgrsvc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var ErrPortMessage = errors.New("Port: invalid arbitration message")
+
+// Types of port arbitration messages.
+const (
+	// PortRequest asks the service holding the port to grant it to Owner.
+	PortRequest = "request"
+	// PortGrant hands the port over to Owner for Lease seconds.
+	PortGrant = "grant"
+	// PortRelease hands the port of Owner back.
+	PortRelease = "release"
+	// PortDeny refuses the request of Owner.
+	PortDeny = "deny"
+)
+
+// DefaultPortOwner is the owner mcumgr-svc goes by in port arbitration
+// messages, unless the handover config names another.
+const DefaultPortOwner = "mcumgr-svc"
+
+// DefaultPortLease is how long a grant holds if the request didn't say.
+const DefaultPortLease = 10 * time.Minute
+
+// PortMessage is a message of the protocol services sharing the serial port of
+// a device negotiate who owns it with. A service requests the port, is granted
+// or denied it, and releases it once done. A grant holds for Lease seconds, after
+// which the granting service takes the port back, so it isn't lost to a peer
+// which died holding it.
+type PortMessage struct {
+	Type   string `json:"type"`
+	Device string `json:"device"`
+	Owner  string `json:"owner"`
+	Lease  int    `json:"lease,omitempty"`
+}
+
+// ParsePortMessage decodes a port arbitration message. Anything but a JSON
+// object, as sent by peers predating the protocol, grants the port to whoever
+// receives it.
+func ParsePortMessage(b []byte) (PortMessage, error) {
+	var m PortMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return PortMessage{Type: PortGrant}, nil
+	}
+	switch m.Type {
+	case PortRequest, PortGrant, PortRelease, PortDeny:
+	default:
+		return PortMessage{}, ErrPortMessage
+	}
+	if m.Lease < 0 {
+		return PortMessage{}, ErrPortMessage
+	}
+	return m, nil
+}
+
+// leaseTimeout returns how long the grant m holds.
+func (m PortMessage) leaseTimeout() time.Duration {
+	if m.Lease == 0 {
+		return DefaultPortLease
+	}
+	return time.Duration(m.Lease) * time.Second
+}
+
+// portLease is the grant of the port to owner, until the timer fires.
+type portLease struct {
+	owner string
+	timer *time.Timer
+}
+
+// arbitrate handles the port arbitration message m. It runs on the goroutine
+// of Run, like everything touching the ownership of the port.
+func (b *mcumgrBackend) arbitrate(ctx context.Context, m PortMessage) {
+	cfg := b.handoverCfg
+	if m.Device != "" && m.Device != b.entry.Bid {
+		return
+	}
+	switch m.Type {
+	case PortGrant:
+		// Grants without an owner come from peers predating the
+		// protocol.
+		if m.Owner != "" && m.Owner != cfg.Owner {
+			return
+		}
+		b.acquire()
+		b.stopLease()
+		if m.Owner != "" {
+			b.startLease(m.Owner, m.leaseTimeout())
+		}
+
+	case PortRelease:
+		if m.Owner == cfg.Owner {
+			return
+		}
+		b.stopLease()
+		b.acquire()
+
+	case PortRequest:
+		if m.Owner == "" || m.Owner == cfg.Owner {
+			return
+		}
+		reply := PortMessage{Type: PortDeny, Device: b.entry.Bid, Owner: m.Owner}
+		// Only an idle port of ours can be handed over.
+		if b.port.release() {
+			b.stopLease()
+			b.startLease(m.Owner, m.leaseTimeout())
+			reply.Type, reply.Lease = PortGrant, m.Lease
+		}
+		b.publish(ctx, reply)
+
+	case PortDeny:
+		// The port stays with the peer; the upload queued waits for a
+		// grant until its context is done.
+	}
+}
+
+// acquire makes the port available to uploads. Duplicate grants leave it
+// as is.
+func (b *mcumgrBackend) acquire() {
+	b.port.acquire()
+}
+
+// How long the release of the port is given to reach the peer once the
+// context of Run is done.
+const releaseTimeout = 5 * time.Second
+
+// release hands the port back to the peer once an update or reset is done
+// with it, or Run is shutting down.
+func (b *mcumgrBackend) release(ctx context.Context) {
+	if b.handoverCfg.Peer == "" {
+		// Without a peer to hand it back to, keep the port available.
+		return
+	}
+	if !b.port.release() {
+		return
+	}
+	b.stopLease()
+	if ctx.Err() != nil {
+		// Rather than leave the peer to wait out the lease, still tell
+		// it on shutdown.
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), releaseTimeout)
+		defer cancel()
+	}
+	b.publish(ctx, PortMessage{Type: PortRelease, Device: b.entry.Bid, Owner: b.handoverCfg.Owner})
+}
+
+// requestPort asks the peer to grant the port.
+func (b *mcumgrBackend) requestPort(ctx context.Context) {
+	cfg := b.handoverCfg
+	b.publish(ctx, PortMessage{
+		Type:   PortRequest,
+		Device: b.entry.Bid,
+		Owner:  cfg.Owner,
+		Lease:  cfg.Lease,
+	})
+}
+
+// expireLease ends the lease once its timer fired: a port granted to a peer
+// which didn't release it in time is taken back, and one granted to us is
+// handed back to the peer unless it is in use, in which case it is once the
+// update is done.
+func (b *mcumgrBackend) expireLease(ctx context.Context) {
+	owner := b.lease.owner
+	b.stopLease()
+	if owner != b.handoverCfg.Owner {
+		b.acquire()
+		return
+	}
+	if b.port.release() {
+		b.publish(ctx, PortMessage{Type: PortRelease, Device: b.entry.Bid, Owner: b.handoverCfg.Owner})
+	}
+}
+
+func (b *mcumgrBackend) startLease(owner string, d time.Duration) {
+	b.lease = &portLease{owner: owner, timer: time.NewTimer(d)}
+}
+
+func (b *mcumgrBackend) stopLease() {
+	if b.lease != nil {
+		b.lease.timer.Stop()
+		b.lease = nil
+	}
+}
+
+// leaseExpired returns the channel the timer of the lease fires on, or nil if
+// there is no lease.
+func (b *mcumgrBackend) leaseExpired() <-chan time.Time {
+	if b.lease == nil {
+		return nil
+	}
+	return b.lease.timer.C
+}
+
+// publish sends m to the peer, if there is one. A message lost on the way is
+// made up for by the lease of the port, so failures are left at that.
+func (b *mcumgrBackend) publish(ctx context.Context, m PortMessage) {
+	if b.handoverCfg.Peer == "" {
+		return
+	}
+	b.handover.Publish(ctx, m)
+}
@@ -0,0 +1,135 @@
+package mcumgrsvc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePortMessage(t *testing.T) {
+	m, err := ParsePortMessage([]byte(`{"type":"request","device":"board-01","owner":"slcan-svc","lease":30}`))
+	assert.Nil(t, err)
+	assert.Equal(t, PortMessage{Type: PortRequest, Device: "board-01", Owner: "slcan-svc", Lease: 30}, m)
+	assert.Equal(t, 30*time.Second, m.leaseTimeout())
+
+	// Peers predating the protocol just hand the port over.
+	m, err = ParsePortMessage([]byte("true"))
+	assert.Nil(t, err)
+	assert.Equal(t, PortMessage{Type: PortGrant}, m)
+	assert.Equal(t, DefaultPortLease, m.leaseTimeout())
+
+	_, err = ParsePortMessage([]byte(`{"type":"steal"}`))
+	assert.Equal(t, ErrPortMessage, err)
+	_, err = ParsePortMessage([]byte(`{"type":"grant","lease":-1}`))
+	assert.Equal(t, ErrPortMessage, err)
+}
+
+func TestArbitrate(t *testing.T) {
+	ctx := context.Background()
+	b := NewMCUMgrBackend(DeviceEntry{Bid: "board-01"}, "").(*mcumgrBackend)
+	b.handoverCfg.Peer = "slcan"
+
+	// Messages for other devices and requests while the port is with the
+	// peer change nothing.
+	b.arbitrate(ctx, PortMessage{Type: PortGrant, Device: "board-02", Owner: DefaultPortOwner})
+	b.arbitrate(ctx, PortMessage{Type: PortRequest, Device: "board-01", Owner: "slcan-svc"})
+	assert.Equal(t, PortReleased, b.port.State())
+
+	b.arbitrate(ctx, PortMessage{Type: PortGrant, Device: "board-01", Owner: DefaultPortOwner, Lease: 60})
+	assert.Equal(t, PortOwned, b.port.State())
+	assert.Equal(t, DefaultPortOwner, b.lease.owner)
+
+	// An idle port is granted on request, and taken back once the lease
+	// of the peer expires.
+	b.arbitrate(ctx, PortMessage{Type: PortRequest, Device: "board-01", Owner: "slcan-svc", Lease: 60})
+	assert.Equal(t, PortReleased, b.port.State())
+	assert.False(t, b.port.use())
+	assert.Equal(t, "slcan-svc", b.lease.owner)
+	b.expireLease(ctx)
+	assert.Equal(t, PortOwned, b.port.State())
+	assert.Nil(t, b.lease)
+
+	// A port in use isn't.
+	assert.True(t, b.port.use())
+	b.arbitrate(ctx, PortMessage{Type: PortRequest, Device: "board-01", Owner: "slcan-svc"})
+	assert.Equal(t, PortBusy, b.port.State())
+
+	b.port.done()
+	b.release(ctx)
+	assert.Equal(t, PortReleased, b.port.State())
+	b.arbitrate(ctx, PortMessage{Type: PortRelease, Device: "board-01", Owner: "slcan-svc"})
+	assert.Equal(t, PortOwned, b.port.State())
+}
+
+func TestReleaseWithoutPeer(t *testing.T) {
+	b := NewMCUMgrBackend(DeviceEntry{Bid: "board-01"}, "").(*mcumgrBackend)
+	b.arbitrate(context.Background(), PortMessage{Type: PortGrant})
+	assert.Equal(t, PortOwned, b.port.State())
+	assert.Nil(t, b.lease)
+
+	// With nobody to hand it back to, the port stays available after an
+	// update.
+	assert.True(t, b.port.use())
+	b.port.done()
+	b.release(context.Background())
+	assert.Equal(t, PortOwned, b.port.State())
+}
+
+func TestLocalHandover(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := NewLocalHandover(true)
+	b := NewMCUMgrBackendHandover(DeviceEntry{Bid: "board-01",
+		Handover: HandoverConfig{Type: HandoverLocal, Peer: "slcan"}}, h).(*mcumgrBackend)
+	pub, stop := h.Published()
+	defer stop()
+
+	// Run arbitrates on the goroutine of the handover here, standing in
+	// for the one of the backend.
+	handled := make(chan PortMessage, 1)
+	go h.Run(ctx, func(ctx context.Context, m PortMessage) error {
+		b.arbitrate(ctx, m)
+		handled <- m
+		return nil
+	})
+	assert.Equal(t, PortMessage{Type: PortGrant}, <-handled)
+	assert.Equal(t, PortOwned, b.port.State())
+	assert.True(t, h.Health().Connected)
+
+	assert.Nil(t, h.Send(ctx, PortMessage{Type: PortRequest, Device: "board-01", Owner: "slcan-svc", Lease: 5}))
+	<-handled
+	assert.Equal(t, PortReleased, b.port.State())
+	assert.Equal(t, PortMessage{Type: PortGrant, Device: "board-01", Owner: "slcan-svc", Lease: 5}, <-pub)
+
+	assert.Nil(t, h.Send(ctx, PortMessage{Type: PortRelease, Device: "board-01", Owner: "slcan-svc"}))
+	<-handled
+	assert.Equal(t, PortOwned, b.port.State())
+}
+
+// TestExpireOwnLease checks a lease of ours running out hands the port back
+// to the peer, once it is no longer in use.
+func TestExpireOwnLease(t *testing.T) {
+	ctx := context.Background()
+	h := NewLocalHandover(false)
+	b := NewMCUMgrBackendHandover(DeviceEntry{Bid: "board-01",
+		Handover: HandoverConfig{Type: HandoverLocal, Peer: "slcan"}}, h).(*mcumgrBackend)
+	pub, stop := h.Published()
+	defer stop()
+	release := PortMessage{Type: PortRelease, Device: "board-01", Owner: DefaultPortOwner}
+
+	b.arbitrate(ctx, PortMessage{Type: PortGrant, Device: "board-01", Owner: DefaultPortOwner, Lease: 60})
+	b.expireLease(ctx)
+	assert.Equal(t, PortReleased, b.port.State())
+	assert.Equal(t, release, <-pub)
+
+	b.arbitrate(ctx, PortMessage{Type: PortGrant, Device: "board-01", Owner: DefaultPortOwner, Lease: 60})
+	assert.True(t, b.port.use())
+	b.expireLease(ctx)
+	assert.Equal(t, PortBusy, b.port.State())
+	assert.Len(t, pub, 0)
+	b.port.done()
+	b.release(ctx)
+	assert.Equal(t, release, <-pub)
+}
@@ -0,0 +1,102 @@
+package mcumgrsvc
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	hawkbit "github.com/jonathanyhliang/hawkbit-fota/backend"
+)
+
+var (
+	ErrArtifactMissing = errors.New("Artifact: download failed")
+	ErrArtifactSize    = errors.New("Artifact: size mismatch")
+	ErrArtifactHash    = errors.New("Artifact: hash mismatch")
+)
+
+// Artifact is what Hawkbit advertises about the artifact of a deployment.
+// Hashes are hex encoded; empty ones and a zero size aren't checked.
+type Artifact struct {
+	Filename string
+	Href     string
+	Size     int
+	SHA1     string
+	MD5      string
+	SHA256   string
+}
+
+// DeployBaseArtifact returns the artifact of the deployment dp, or the zero
+// Artifact if it has none.
+func DeployBaseArtifact(dp hawkbit.DeploymentBase) Artifact {
+	// Chunks and artifacts are single element arrays, left empty by a
+	// deployment without an artifact.
+	a := dp.Deployment.Chunks[0].Artifacts[0]
+	if a.Links.DownloadHttp.Href == "" {
+		return Artifact{}
+	}
+	return Artifact{
+		Filename: a.Filename,
+		Href:     a.Links.DownloadHttp.Href,
+		Size:     a.Size,
+		SHA1:     a.Hashes.SHA1,
+		MD5:      a.Hashes.MD5,
+		SHA256:   a.Hashes.SHA256,
+	}
+}
+
+// artifactHasher computes the size and hashes of an artifact as it is
+// written, so it can be checked while it streams to disk.
+type artifactHasher struct {
+	n      int64
+	sha1   hash.Hash
+	md5    hash.Hash
+	sha256 hash.Hash
+}
+
+func newArtifactHasher() *artifactHasher {
+	return &artifactHasher{
+		sha1:   sha1.New(),
+		md5:    md5.New(),
+		sha256: sha256.New(),
+	}
+}
+
+func (h *artifactHasher) Write(p []byte) (int, error) {
+	h.n += int64(len(p))
+	h.sha1.Write(p)
+	h.md5.Write(p)
+	h.sha256.Write(p)
+	return len(p), nil
+}
+
+// check compares what h was fed with the artifact.
+func (a Artifact) check(h *artifactHasher) error {
+	if a.Size != 0 && int64(a.Size) != h.n {
+		return fmt.Errorf("%w: expected %d bytes, got %d", ErrArtifactSize, a.Size, h.n)
+	}
+
+	for _, d := range []struct {
+		name string
+		want string
+		h    hash.Hash
+	}{
+		{"sha1", a.SHA1, h.sha1},
+		{"md5", a.MD5, h.md5},
+		{"sha256", a.SHA256, h.sha256},
+	} {
+		if d.want == "" {
+			continue
+		}
+		got := hex.EncodeToString(d.h.Sum(nil))
+		if !strings.EqualFold(got, d.want) {
+			return fmt.Errorf("%w: expected %s %s, got %s", ErrArtifactHash, d.name, d.want, got)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package mcumgrsvc
+
+import (
+	"errors"
+	"testing"
+
+	hawkbit "github.com/jonathanyhliang/hawkbit-fota/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+// checkArtifact checks f against the artifact a, as Cache.Fetch does.
+func checkArtifact(a Artifact, f []byte) error {
+	h := newArtifactHasher()
+	h.Write(f)
+	return a.check(h)
+}
+
+func TestArtifactCheck(t *testing.T) {
+	f := []byte("firmware")
+	a := Artifact{
+		Size:   len(f),
+		SHA1:   "9bcf18e4b22c0710ed69d3e91fb8285b936cdea7",
+		MD5:    "74B5B5E9570EFC5C0553BB327CD41940",
+		SHA256: "c3bf47ea1f4a4a605470313cacb3a44f4a461f68c6faeab07e737610cb5ac835",
+	}
+	assert.Nil(t, checkArtifact(a, f))
+	assert.Nil(t, checkArtifact(Artifact{}, f))
+
+	assert.True(t, errors.Is(checkArtifact(a, f[:4]), ErrArtifactSize))
+
+	b := []byte("firmwarE")
+	a.Size = 0
+	assert.True(t, errors.Is(checkArtifact(a, b), ErrArtifactHash))
+	a.SHA1 = ""
+	assert.True(t, errors.Is(checkArtifact(a, b), ErrArtifactHash))
+	a.MD5 = ""
+	err := checkArtifact(a, b)
+	assert.True(t, errors.Is(err, ErrArtifactHash))
+	assert.Contains(t, err.Error(), "sha256")
+}
+
+func TestDeployBaseArtifact(t *testing.T) {
+	var dp hawkbit.DeploymentBase
+	assert.Equal(t, Artifact{}, DeployBaseArtifact(dp))
+
+	a := &dp.Deployment.Chunks[0].Artifacts[0]
+	a.Filename, a.Size = "zephyr.signed.bin", 8
+	a.Links.DownloadHttp.Href = "http://hawkbit/download/zephyr.signed.bin"
+	assert.Equal(t, Artifact{Filename: "zephyr.signed.bin", Href: "http://hawkbit/download/zephyr.signed.bin",
+		Size: 8}, DeployBaseArtifact(dp))
+}
@@ -1,23 +1,24 @@
 package mcumgrsvc
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"time"
 
-	"gopkg.in/cheggaaa/pb.v1"
-	"mynewt.apache.org/newt/util"
+	"github.com/jonathanyhliang/mcumgr-svc/mcuboot"
 	"mynewt.apache.org/newtmgr/newtmgr/config"
-	"mynewt.apache.org/newtmgr/nmxact/nmcoap"
 	"mynewt.apache.org/newtmgr/nmxact/nmp"
-	"mynewt.apache.org/newtmgr/nmxact/nmserial"
 	"mynewt.apache.org/newtmgr/nmxact/sesn"
 	"mynewt.apache.org/newtmgr/nmxact/xact"
-	"mynewt.apache.org/newtmgr/nmxact/xport"
-
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 // http://www.dest-unreach.org/socat/doc/socat-ttyovertcp.txt
@@ -34,171 +35,705 @@ var (
 	ErrBackendPort      = errors.New("Backend: invalid port setting")
 	ErrBackendImage     = errors.New("Backend: invalid image")
 	ErrBackendReset     = errors.New("Backend: failed to reset")
+	ErrBackendFilter    = errors.New("Backend: unknown CoAP filters")
+	ErrBackendState     = errors.New("Backend: failed to read or write image state")
+	ErrBackendErase     = errors.New("Backend: failed to erase image")
+	ErrBackendVerify    = errors.New("Backend: device didn't boot the deployed image")
+	ErrBackendBusy      = errors.New("Backend: port in use")
+	ErrBackendUpload    = errors.New("Backend: failed to upload image")
+	ErrBackendResume    = errors.New("Backend: device has no upload to resume")
+	ErrBackendClosed    = errors.New("Backend: not running")
+	ErrBackendPanic     = errors.New("Backend: panic")
 )
 
-var globalSesn sesn.Sesn
-var globalXport xport.Xport
-var globalP *config.ConnProfile
+const (
+	uploadTries         = 3
+	uploadRetryInterval = 3 * time.Second
+)
 
-// This keeps track of whether the global interface has been assigned.  This
-// is necessary to accommodate golang's nil-interface semantics.
-var globalXportSet bool
-var globalTxFilter nmcoap.TxMsgFilter
-var globalRxFilter nmcoap.RxMsgFilter
+// uploadTimeout is how long an upload request waits for the device to answer.
+var uploadTimeout = 5 * time.Second
+
+// UploadOptions tunes how an image is uploaded to the device. The zero value
+// uploads to image slot 0 with the default window size, erasing the slot first.
+type UploadOptions struct {
+	// ImageNum is the image number to upload to on multi-image setups.
+	ImageNum int `json:"image,omitempty"`
+	// NoErase skips erasing the slot before the upload.
+	NoErase bool `json:"noErase,omitempty"`
+	// Upgrade makes the device reject images that aren't newer than the
+	// one it runs.
+	Upgrade bool `json:"upgrade,omitempty"`
+	// MaxWinSz is the maximum number of upload requests in flight, or
+	// xact.IMAGE_UPLOAD_DEF_MAX_WS if zero.
+	MaxWinSz int `json:"maxWinSz,omitempty"`
+}
 
 type Backend interface {
-	Handler(port string, baud int, url string) error
-	UploadImage(f []byte) error
-	Reset()
-	GetStatus() (exec, result string)
+	Run(ctx context.Context) error
+	UploadImage(ctx context.Context, r io.ReaderAt, size int64, opt UploadOptions) error
+	Reset(ctx context.Context) error
+	State() *StateMachine
+	LastError() error
+	ListImages(ctx context.Context) ([]ImageSlot, error)
+	TestImage(ctx context.Context, hash []byte) error
+	ConfirmImage(ctx context.Context, hash []byte) error
+	EraseImage(ctx context.Context) error
+	VerifyImage(ctx context.Context, imageNum int, hash []byte) (ImageSlot, error)
+	Subscribe() (<-chan Progress, func())
+	SetUploadOffset(hash []byte, off int64)
+	HandoverHealth() HandoverHealth
+	PortState() PortState
 }
 
-type mcumgrBackend struct {
-	upld chan bool
-	rst  chan bool
-	ping chan bool
+// backendReq is a device command run by Run, which serialises it with
+// uploads and resets, or for pings, the port arbitration message handled.
+type backendReq struct {
+	ctx context.Context
+	fn  func(ctx context.Context, d *Device) error
+	msg PortMessage
+	err chan error
+}
+
+// uploadJob is an image UploadImage scheduled for upload.
+type uploadJob struct {
+	ctx  context.Context
 	img  []byte
-	mtx  sync.Mutex
-	sta  struct {
-		exec   string
-		result string
-		mtx    sync.Mutex
-	}
+	hash []byte
+	ver  string
+	free func()
+	opt  UploadOptions
+}
+
+type mcumgrBackend struct {
+	dev   *Device
+	entry DeviceEntry
+	rst   chan backendReq
+	ping  chan backendReq
+	req   chan backendReq
+	done  chan struct{}
+	port  *portOwner
+	state *StateMachine
+	// lastErr is the last error the update pipeline failed with.
+	lastErr struct {
+		err error
+		mtx sync.Mutex
+	}
+	// keys are the public keys images must be signed with, loaded from
+	// the files of the entry, or keysErr why they couldn't be.
+	keys    []crypto.PublicKey
+	keysErr error
+	// offs holds the last offset the device acknowledged for images whose
+	// upload failed, by image hash.
+	offs struct {
+		m   map[string]uint32
+		mtx sync.Mutex
+	}
+	progress hub[Progress]
+	handover Handover
+	// handoverErr is why there is no handover, ErrHandoverType if unset.
+	handoverErr error
+	// handoverCfg is the handover config of the entry, with defaults.
+	handoverCfg HandoverConfig
+	// lease is the grant of the port in force, which only Run touches.
+	lease *portLease
+	// running is the update Run runs off its loop, which only Run touches.
+	running *runningUpdate
+}
+
+// runningUpdate is an update running off the loop of Run, which keeps
+// serving resets, device commands and port arbitration meanwhile.
+type runningUpdate struct {
+	cancel context.CancelFunc
+	// done receives the error of the update once it is done.
+	done chan error
+}
+
+// NewMCUMgrBackend returns a Backend managing the device of entry e, which
+// waits for its port to be handed over on the broker at url, as its handover
+// config says.
+func NewMCUMgrBackend(e DeviceEntry, url string) Backend {
+	// An invalid handover type or broker URL leaves the backend without a
+	// handover, and Run fails with the error.
+	h, err := NewHandover(e.Bid, e.handoverConfig(), url)
+	b := NewMCUMgrBackendHandover(e, h).(*mcumgrBackend)
+	b.handoverErr = err
+	return b
 }
 
-func NewMCUMgrBackend() Backend {
+// NewMCUMgrBackendHandover returns a Backend managing the device of entry e,
+// which waits for its port to be handed over by h.
+func NewMCUMgrBackendHandover(e DeviceEntry, h Handover) Backend {
+	// Keys that can't be loaded fail uploads and Run with the error, rather
+	// than let unsigned images through.
+	keys, err := mcuboot.LoadPublicKeys(e.Keys)
 	return &mcumgrBackend{
-		upld: make(chan bool),
-		rst:  make(chan bool),
-		ping: make(chan bool),
+		entry: e,
+		rst:   make(chan backendReq),
+		ping:  make(chan backendReq),
+		req:   make(chan backendReq),
+		done:  make(chan struct{}),
+		port:  newPortOwner(),
+		state: NewStateMachine(),
+
+		handover:    h,
+		handoverCfg: e.handoverConfig().withDefaults(),
+		keys:        keys,
+		keysErr:     err,
 	}
 }
 
-func (b *mcumgrBackend) Handler(port string, baud int, url string) error {
-	b.setStatus("closed", "none")
-	args := make([]string, 3)
-	args[0] = "acm"
-	args[1] = "type=serial"
-	args[2] = fmt.Sprintf("connstring=dev=%s,baud=%d,mtu=512", port, baud)
-	err := connProfileAddCmd(args)
+// Run serves the device until ctx is done, then releases and closes its port.
+// Uploads, resets and device commands are only carried out while Run runs.
+// Should the handover stop on its own, Run returns its error, or
+// ErrHandoverClosed. A panic talking to the device or the peer fails Run with
+// ErrBackendPanic.
+func (b *mcumgrBackend) Run(ctx context.Context) (err error) {
+	defer func() { b.setError(err) }()
+	defer recoverPanic(&err)
+	// Once the port is closed no upload is queued, so the one dropped is
+	// the last.
+	defer func() {
+		close(b.done)
+		b.port.close()
+		b.dropUpload(ErrBackendClosed)
+	}()
+
+	if b.handover == nil {
+		return b.noHandover()
+	}
+	if b.keysErr != nil {
+		return b.keysErr
+	}
+	e := b.entry
+	dev, err := NewDevice(e.connProfileArgs())
 	if err != nil {
 		return err
 	}
+	if e.Filters != "" {
+		txFilter, rxFilter, ok := lookupCoapFilters(e.Filters)
+		if !ok {
+			return ErrBackendFilter
+		}
+		dev.SetFilters(txFilter, rxFilter)
+	}
+	b.dev = dev
+	defer b.dev.Close()
 
-	b.mtx.Lock()
-
+	// The handover outlives ctx until the port is released, so the peer
+	// hears of it on shutdown.
+	hctx, stopHandover := context.WithCancel(context.Background())
+	defer stopHandover()
+	handed := make(chan error, 1)
 	go func() {
-		b.msgQueueReceive(url)
+		var err error
+		defer func() { handed <- err }()
+		defer recoverPanic(&err)
+		err = b.handover.Run(hctx, b.claim)
+	}()
+	// However Run returns, the update running is aborted and the port
+	// handed back while the handover still runs.
+	defer func() {
+		b.abortUpdate(ctx)
+		b.release(ctx)
 	}()
 
 	for {
 		select {
-		case <-b.upld:
-			b.setStatus("proceeding", "none")
-			err = imageUploadCmd(b.img)
-			b.setStatus("downloaded", "success")
+		case <-ctx.Done():
+			return nil
 
-		case <-b.rst:
-			err = resetRunCmd([]string{})
-			if err != nil {
+		case err := <-handed:
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err == nil {
+				err = ErrHandoverClosed
+			}
+			return err
 
+		case <-b.port.queued:
+			// Start the upload right away if the port is ours, or
+			// ask the peer for it.
+			if !b.runUpload(ctx) {
+				b.requestPort(ctx)
 			}
-			// Close opening serial port
-			time.Sleep(3 * time.Second)
-			cleanup()
-			b.mtx.Unlock()
 
-		case <-b.ping:
-			// Establish serial connection as soon as pinged by SLCAN service
-			b.mtx.Unlock()
+		case err := <-b.updateDone():
+			b.finishUpdate(ctx, err)
+			if errors.Is(err, ErrBackendPanic) {
+				return err
+			}
 
-		default:
+		case <-b.uploadExpired():
+			b.dropUpload(nil)
+
+		case r := <-b.rst:
+			// Only a port of ours nothing else is using can be reset.
+			if !b.port.use() {
+				r.err <- ErrBackendBusy
+				continue
+			}
+			// A context done before abortOn watched it would be missed.
+			stop := b.dev.abortOn(r.ctx)
+			err := r.ctx.Err()
+			if err == nil {
+				err = b.reset(r.ctx)
+			}
+			stop()
+			b.setError(err)
+			r.err <- err
+			b.port.done()
+			b.release(ctx)
+
+		case r := <-b.ping:
+			// Establish serial connection as soon as granted the port
+			// by the SLCAN service
+			b.arbitrate(ctx, r.msg)
+			r.err <- nil
+			b.runUpload(ctx)
+
+		case <-b.leaseExpired():
+			b.expireLease(ctx)
+			b.runUpload(ctx)
+
+		case r := <-b.req:
+			if !b.port.use() {
+				r.err <- ErrBackendBusy
+				continue
+			}
+			stop := b.dev.abortOn(r.ctx)
+			err := r.ctx.Err()
+			if err == nil {
+				err = r.fn(r.ctx, b.dev)
+			}
+			stop()
+			r.err <- err
+			b.port.done()
 		}
 	}
 }
 
-func (b *mcumgrBackend) UploadImage(f []byte) error {
-	if f == nil {
+// UploadImage schedules the update of the device to the image of the given
+// size read from r: the image is uploaded, then installed as the device entry
+// says. Follow the update with State. The update is aborted, releasing the
+// port, once ctx is done, so ctx must outlive it. On unix, images passed as an
+// *os.File are mapped read-only rather than read, so they don't take up heap
+// however large they are; any other r is read into memory as a whole. If the
+// port wasn't handed over, the update waits in StateScheduled for the peer to
+// grant it, and is dropped once ctx is done. UploadImage fails with
+// ErrBackendBusy while another update is in progress or waiting. The port is
+// released once the update is done.
+func (b *mcumgrBackend) UploadImage(ctx context.Context, r io.ReaderAt, size int64, opt UploadOptions) error {
+	if r == nil || opt.ImageNum < 0 || opt.MaxWinSz < 0 {
 		return ErrBackendImage
 	}
-	if b.mtx.TryLock() {
-		b.setStatus("scheduled", "none")
-		b.img = f
-		b.upld <- true
+	if b.keysErr != nil {
+		return b.keysErr
+	}
+	// Refuse anything that isn't an MCUboot image, e.g. an error page
+	// returned by the download endpoint, and, with trusted keys set,
+	// anything they didn't sign.
+	img, err := mcuboot.ParseReader(r, size)
+	if err != nil {
+		return err
+	}
+	if len(b.keys) > 0 {
+		if err := img.VerifySignature(b.keys); err != nil {
+			return err
+		}
+	}
+	select {
+	case <-b.done:
+		return ErrBackendClosed
+	default:
+	}
+	if !b.port.available() {
+		return ErrBackendBusy
+	}
+	f, free, err := mapImage(r, size)
+	if err != nil {
+		return err
+	}
+	if err := b.state.Transition(StateScheduled, nil); err != nil {
+		free()
+		return err
 	}
 
+	j := uploadJob{
+		ctx:  ctx,
+		img:  f,
+		hash: img.Hash,
+		ver:  img.Header.Version.String(),
+		free: free,
+		opt:  opt,
+	}
+	if err := b.port.schedule(j); err != nil {
+		free()
+		b.state.Fail(err)
+		return err
+	}
 	return nil
 }
 
-func (b *mcumgrBackend) Reset() {
-	b.rst <- true
-	return
+// runUpload starts the update queued off the loop of Run, provided the port is
+// owned and idle, and reports whether it did. The port stays busy, so resets
+// and device commands fail with ErrBackendBusy, until Run finishes the update.
+func (b *mcumgrBackend) runUpload(ctx context.Context) bool {
+	j, ok := b.port.next()
+	if !ok {
+		return false
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	r := &runningUpdate{cancel: cancel, done: make(chan error, 1)}
+	b.running = r
+	go func() {
+		var err error
+		defer func() { r.done <- err }()
+		defer recoverPanic(&err)
+		err = b.update(ctx, j)
+	}()
+	return true
 }
 
-func (b *mcumgrBackend) setStatus(exec, result string) {
-	b.sta.mtx.Lock()
-	b.sta.exec = exec
-	b.sta.result = result
-	defer b.sta.mtx.Unlock()
+// updateDone returns the channel the update running sends its error on once
+// done, or nil if there is none.
+func (b *mcumgrBackend) updateDone() <-chan error {
+	if b.running == nil {
+		return nil
+	}
+	return b.running.done
 }
 
-func (b *mcumgrBackend) GetStatus() (exec, result string) {
-	b.sta.mtx.Lock()
-	defer b.sta.mtx.Unlock()
-	return b.sta.exec, b.sta.result
+// finishUpdate closes the port once the update running is done, failing with
+// err if not nil, and hands the port back.
+func (b *mcumgrBackend) finishUpdate(ctx context.Context, err error) {
+	b.running.cancel()
+	b.running = nil
+	if err != nil {
+		b.setError(err)
+		b.state.Fail(err)
+	}
+	b.dev.Close()
+	b.port.done()
+	b.release(ctx)
 }
 
-func (b *mcumgrBackend) msgQueueReceive(url string) error {
-	conn, err := amqp.Dial(url)
-	if err != nil {
+// abortUpdate aborts the update running, if any, and finishes it once done.
+func (b *mcumgrBackend) abortUpdate(ctx context.Context) {
+	if b.running == nil {
+		return
+	}
+	b.running.cancel()
+	b.finishUpdate(ctx, <-b.running.done)
+}
 
+// uploadExpired returns the channel closed once the context of the update
+// queued is done, or nil if there is none.
+func (b *mcumgrBackend) uploadExpired() <-chan struct{} {
+	j, ok := b.port.waiting()
+	if !ok {
+		return nil
 	}
-	defer conn.Close()
+	return j.ctx.Done()
+}
 
-	ch, err := conn.Channel()
-	if err != nil {
+// dropUpload fails the update queued with err, or with the error of its
+// context if err is nil.
+func (b *mcumgrBackend) dropUpload(err error) {
+	j, ok := b.port.drop()
+	if !ok {
+		return
+	}
+	if err == nil {
+		err = j.ctx.Err()
+	}
+	j.free()
+	b.setError(err)
+	b.state.Fail(err)
+}
 
+// update uploads and installs the image of j, until either ctx or the context
+// of j is done.
+func (b *mcumgrBackend) update(ctx context.Context, j uploadJob) error {
+	defer j.free()
+	ctx, cancel := mergeContext(j.ctx, ctx)
+	defer cancel()
+	defer b.dev.abortOn(ctx)()
+
+	if err := b.state.Transition(StateUploading, nil); err != nil {
+		return err
+	}
+	if err := b.upload(ctx, j); err != nil {
+		return err
+	}
+	return b.install(ctx, j)
+}
+
+// install resets the device into the image of j just uploaded. In swap mode
+// the image is marked for test first and confirmed once it runs; in swap and
+// verify mode the device must come back up running it. A device staging the
+// image in a secondary slot is updated in swap mode whatever its entry says.
+func (b *mcumgrBackend) install(ctx context.Context, j uploadJob) error {
+	swap, verify := b.entry.Swap || b.staged(j), b.entry.Verify
+	if err := b.state.Transition(StateResetting, nil); err != nil {
+		return err
+	}
+	if swap {
+		if err := b.dev.imageStateWriteCmd(j.hash, false); err != nil {
+			return err
+		}
+	}
+	if err := b.reset(ctx); err != nil {
+		return err
+	}
+	if !swap && !verify {
+		return b.state.Transition(StateDone, nil)
 	}
-	defer ch.Close()
 
-	q, err := ch.QueueDeclare(
-		"handover", // name
-		false,      // durable
-		false,      // delete when unused
-		false,      // exclusive
-		false,      // no-wait
-		nil,        // arguments
-	)
+	if err := b.state.Transition(StateVerifying, nil); err != nil {
+		return err
+	}
+	active, err := verifyImage(ctx, b.dev.readImageState, j.opt.ImageNum, j.hash)
 	if err != nil {
+		return verifyError(err, j.ver, active)
+	}
+	if !swap {
+		return b.state.Transition(StateDone, nil)
+	}
 
+	if err := b.state.Transition(StateConfirming, nil); err != nil {
+		return err
 	}
+	if err := b.dev.imageStateWriteCmd(j.hash, true); err != nil {
+		return err
+	}
+	return b.state.Transition(StateDone, nil)
+}
 
-	msgs, err := ch.Consume(
-		q.Name, // queue
-		"",     // consumer
-		true,   // auto-ack
-		false,  // exclusive
-		false,  // no-local
-		false,  // no-wait
-		nil,    // args
-	)
+// staged reports whether the device staged the image of j in a secondary slot,
+// as MCUboot in swap mode has it, which only boots it once marked for test.
+// Devices updated in serial recovery mode take the image in the primary slot.
+func (b *mcumgrBackend) staged(j uploadJob) bool {
+	slots, err := b.dev.imageStateReadCmd()
 	if err != nil {
+		return false
+	}
+	for _, s := range slots {
+		if s.Image == j.opt.ImageNum && s.Slot != 0 && !s.Active && bytes.Equal(s.Hash, j.hash) {
+			return true
+		}
+	}
+	return false
+}
 
+// reset resets the device and closes the port, which goes away while the
+// device reboots.
+func (b *mcumgrBackend) reset(ctx context.Context) error {
+	err := b.dev.resetRunCmd([]string{})
+	if err == nil {
+		err = sleep(ctx, 3*time.Second)
 	}
+	b.dev.Close()
+	return err
+}
 
-	for {
-		for d := range msgs {
-			if d.Body != nil {
-				b.ping <- true
-			}
+// upload uploads the image of j, trying up to uploadTries times. Once part of
+// the image was acknowledged, a retry queries the device with the chunk at the
+// last offset it acknowledged, and resumes from wherever the device says its
+// upload stands. Should the device reject the resumed upload, e.g. because it
+// rebooted in between, the next try starts over; a resumed upload failing
+// otherwise, e.g. timing out, is resumed again.
+func (b *mcumgrBackend) upload(ctx context.Context, j uploadJob) error {
+	key := hex.EncodeToString(j.hash)
+	m := newProgressMeter(int64(len(j.img)), b.uploadOff(key))
+	var err error
+	for try := 1; ; try++ {
+		off := b.uploadOff(key)
+		err = b.dev.imageUploadCmd(j.img, j.opt, off, func(off uint32) {
+			b.setUploadOff(key, off)
+			b.progress.publish(m.event(off))
+		})
+		if err == nil {
+			b.setUploadOff(key, 0)
+			return nil
 		}
+		if ctx.Err() != nil {
+			// Aborted rather than failed, so keep the offset for
+			// the next upload of the image.
+			return fmt.Errorf("%w: %v", ctx.Err(), err)
+		}
+		if try == uploadTries {
+			return err
+		}
+		if errors.Is(err, ErrBackendResume) {
+			b.setUploadOff(key, 0)
+		}
+		// Reconnect, the port may have gone away with the upload.
+		b.dev.Close()
+		if err := sleep(ctx, uploadRetryInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the progress events of image uploads,
+// and a function to unsubscribe, which closes the channel. Events are dropped
+// while the channel is full.
+func (b *mcumgrBackend) Subscribe() (<-chan Progress, func()) {
+	return b.progress.subscribe()
+}
+
+// SetUploadOffset has the next upload of the image with the given hash resume
+// from offset off, e.g. one acknowledged before a restart.
+func (b *mcumgrBackend) SetUploadOffset(hash []byte, off int64) {
+	if off < 0 || off > math.MaxUint32 {
+		return
 	}
+	b.setUploadOff(hex.EncodeToString(hash), uint32(off))
 }
 
-func connProfileAddCmd(args []string) error {
+func (b *mcumgrBackend) uploadOff(key string) uint32 {
+	b.offs.mtx.Lock()
+	defer b.offs.mtx.Unlock()
+	return b.offs.m[key]
+}
+
+func (b *mcumgrBackend) setUploadOff(key string, off uint32) {
+	b.offs.mtx.Lock()
+	defer b.offs.mtx.Unlock()
+	if off == 0 {
+		delete(b.offs.m, key)
+		return
+	}
+	if b.offs.m == nil {
+		b.offs.m = make(map[string]uint32)
+	}
+	b.offs.m[key] = off
+}
+
+// recoverPanic, deferred, turns a panic of the goroutine into an
+// ErrBackendPanic stored in err, so one misbehaving device fails its backend
+// rather than the process.
+func recoverPanic(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("%w: %v\n%s", ErrBackendPanic, r, debug.Stack())
+	}
+}
+
+// sleep waits for d, or fails with the error of ctx if it is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// mergeContext returns a context derived from ctx, which is also cancelled
+// once other is done.
+func mergeContext(ctx, other context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-other.Done():
+			cancel()
+		case <-stop:
+		}
+	}()
+	return ctx, func() {
+		close(stop)
+		cancel()
+	}
+}
+
+// Reset resets the device, then closes the port and releases it. It fails
+// with ErrBackendBusy unless the port is handed over and idle.
+func (b *mcumgrBackend) Reset(ctx context.Context) error {
+	return b.send(ctx, b.rst, backendReq{ctx: ctx, err: make(chan error, 1)})
+}
+
+// LastError returns the last error the update pipeline failed with, or nil.
+func (b *mcumgrBackend) LastError() error {
+	b.lastErr.mtx.Lock()
+	defer b.lastErr.mtx.Unlock()
+	return b.lastErr.err
+}
+
+// setError records err as the last error, unless it is nil.
+func (b *mcumgrBackend) setError(err error) {
+	if err == nil {
+		return
+	}
+	b.lastErr.mtx.Lock()
+	b.lastErr.err = err
+	b.lastErr.mtx.Unlock()
+}
+
+// exec runs fn against the device from Run and returns its error, or
+// ErrBackendBusy unless the port is handed over and idle.
+func (b *mcumgrBackend) exec(ctx context.Context, fn func(ctx context.Context, d *Device) error) error {
+	return b.send(ctx, b.req, backendReq{ctx: ctx, fn: fn, err: make(chan error, 1)})
+}
+
+// send hands r to Run on c and waits for its error.
+func (b *mcumgrBackend) send(ctx context.Context, c chan backendReq, r backendReq) error {
+	select {
+	case c <- r:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-b.done:
+		return ErrBackendClosed
+	}
+	select {
+	case err := <-r.err:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// claim hands the port arbitration message m to Run, returning once it was
+// handled.
+func (b *mcumgrBackend) claim(ctx context.Context, m PortMessage) error {
+	return b.send(ctx, b.ping, backendReq{ctx: ctx, msg: m, err: make(chan error, 1)})
+}
+
+// HandoverHealth returns the state of the connection the port is handed over
+// on.
+func (b *mcumgrBackend) HandoverHealth() HandoverHealth {
+	if b.handover == nil {
+		return HandoverHealth{Err: b.noHandover()}
+	}
+	return b.handover.Health()
+}
+
+// noHandover returns why the backend has no handover.
+func (b *mcumgrBackend) noHandover() error {
+	if b.handoverErr != nil {
+		return b.handoverErr
+	}
+	return ErrHandoverType
+}
+
+// PortState returns who holds the serial port of the device.
+func (b *mcumgrBackend) PortState() PortState {
+	return b.port.State()
+}
+
+// State returns the state machine tracking the update of the device.
+func (b *mcumgrBackend) State() *StateMachine {
+	return b.state
+}
+
+func connProfileAddCmd(args []string) (*config.ConnProfile, error) {
 	// Connection Profile name required
 	if len(args) == 0 {
-		return ErrBackendPort
+		return nil, ErrBackendPort
 	}
 
 	name := args[0]
@@ -213,39 +748,47 @@ func connProfileAddCmd(args []string) error {
 			var err error
 			cp.Type, err = config.ConnTypeFromString(s[1])
 			if err != nil {
-				return ErrBackendPort
+				return nil, ErrBackendPort
 			}
 		case "connstring":
 			cp.ConnString = s[1]
 		default:
-			return ErrBackendPort
+			return nil, ErrBackendPort
 		}
 	}
 
 	// Check that a type is specified.
 	if cp.Type == config.CONN_TYPE_NONE {
-		return ErrBackendPort
+		return nil, ErrBackendPort
 	}
 
-	globalP = cp
-
-	return nil
+	return cp, nil
 }
 
-func imageUploadCmd(img []byte) error {
-	noerase := false
-	imageNum := 0
-	upgrade := false
-	maxWinSz := xact.IMAGE_UPLOAD_DEF_MAX_WS
+// imageUploadCmd uploads img from offset off on, calling progress with every
+// offset the device acknowledges. Uploads from offset 0 erase the slot first,
+// unless told otherwise.
+func (d *Device) imageUploadCmd(img []byte, uo UploadOptions, off uint32, progress func(off uint32)) error {
+	noerase := uo.NoErase
+	imageNum := uo.ImageNum
+	upgrade := uo.Upgrade
+	maxWinSz := uo.MaxWinSz
+	if maxWinSz == 0 {
+		maxWinSz = xact.IMAGE_UPLOAD_DEF_MAX_WS
+	}
 
-	s, err := getSesn()
+	s, err := d.session()
 	if err != nil {
-		return ErrBackendImage
+		return fmt.Errorf("%w: %v", ErrBackendUpload, err)
+	}
+
+	if off != 0 {
+		return d.imageResumeCmd(s, img, uo, off, progress)
 	}
 
 	c := xact.NewImageUpgradeCmd()
 	var opt = sesn.TxOptions{
-		Timeout: time.Duration(5 * float64(time.Second)),
+		Timeout: uploadTimeout,
 		Tries:   2,
 	}
 	c.SetTxOptions(opt)
@@ -258,142 +801,90 @@ func imageUploadCmd(img []byte) error {
 	}
 	c.ImageNum = imageNum
 	c.Upgrade = upgrade
-	c.ProgressBar = pb.StartNew(len(img))
-	c.ProgressBar.SetUnits(pb.U_BYTES)
-	c.ProgressBar.ShowSpeed = true
 	c.LastOff = 0
 	c.MaxWinSz = maxWinSz
 	c.ProgressCb = func(cmd *xact.ImageUploadCmd, rsp *nmp.ImageUploadRsp) {
 		if rsp.Off > c.LastOff {
-			c.ProgressBar.Add(int(rsp.Off - c.LastOff))
 			c.LastOff = rsp.Off
+			progress(rsp.Off)
 		}
 	}
 
 	res, err := c.Run(s)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %v", ErrBackendUpload, err)
 	}
 
 	if res.Status() != 0 {
-		return ErrBackendImage
+		return fmt.Errorf("%w: rc=%d", ErrBackendUpload, res.Status())
 	}
 
-	c.ProgressBar.Finish()
-
 	return nil
 }
 
-func resetRunCmd(args []string) error {
-	s, err := getSesn()
-	if err != nil {
-		return ErrBackendReset
+// imageResumeCmd continues an interrupted upload of img at offset off. The
+// device answers the first request with the offset it expects next, which the
+// upload carries on from, and fails it if it has no upload of img in progress,
+// in which case imageResumeCmd fails with ErrBackendResume.
+func (d *Device) imageResumeCmd(s sesn.Sesn, img []byte, uo UploadOptions, off uint32, progress func(off uint32)) error {
+	if int(off) >= len(img) {
+		return ErrBackendImage
+	}
+	maxWinSz := uo.MaxWinSz
+	if maxWinSz == 0 {
+		maxWinSz = xact.IMAGE_UPLOAD_DEF_MAX_WS
 	}
 
-	c := xact.NewResetCmd()
+	c := xact.NewImageUploadCmd()
 	var opt = sesn.TxOptions{
-		Timeout: time.Duration(5 * float64(time.Second)),
+		Timeout: uploadTimeout,
 		Tries:   2,
 	}
 	c.SetTxOptions(opt)
-
-	if _, err := c.Run(s); err != nil {
-		return ErrBackendReset
-	}
-
-	return nil
-}
-
-func getSesn() (sesn.Sesn, error) {
-	if globalSesn != nil {
-		return globalSesn, nil
-	}
-
-	var s sesn.Sesn
-
-	sc, err := buildSesnCfg()
-	if err != nil {
-		return nil, err
-	}
-	sc.TxFilter = globalTxFilter
-	sc.RxFilter = globalRxFilter
-
-	x, err := getXport()
-	if err != nil {
-		return nil, err
+	c.Data = img
+	c.StartOff = int(off)
+	c.ImageNum = uo.ImageNum
+	c.Upgrade = uo.Upgrade
+	c.MaxWinSz = maxWinSz
+	lastOff := off
+	c.ProgressCb = func(cmd *xact.ImageUploadCmd, rsp *nmp.ImageUploadRsp) {
+		if rsp.Off != lastOff {
+			lastOff = rsp.Off
+			progress(rsp.Off)
+		}
 	}
 
-	s, err = x.BuildSesn(sc)
+	res, err := c.Run(s)
 	if err != nil {
-		return nil, util.ChildNewtError(err)
+		return fmt.Errorf("%w: %v", ErrBackendUpload, err)
 	}
 
-	globalSesn = s
-	if err := globalSesn.Open(); err != nil {
-		return nil, util.ChildNewtError(err)
-	}
-
-	return globalSesn, nil
-}
-
-func getXport() (xport.Xport, error) {
-	if globalXport != nil {
-		return globalXport, nil
-	}
-
-	cp := globalP
-	switch cp.Type {
-	case config.CONN_TYPE_SERIAL_PLAIN, config.CONN_TYPE_SERIAL_OIC:
-		sc, err := config.ParseSerialConnString(cp.ConnString)
-		if err != nil {
-			return nil, err
+	if res.Status() != 0 {
+		if lastOff == off {
+			return fmt.Errorf("%w: rc=%d", ErrBackendResume, res.Status())
 		}
-
-		globalXport = nmserial.NewSerialXport(sc)
-	default:
-		return nil, util.FmtNewtError("Unknown connection type: %s (%d)",
-			config.ConnTypeToString(cp.Type), int(cp.Type))
-	}
-
-	globalXportSet = true
-
-	if err := globalXport.Start(); err != nil {
-		return nil, util.ChildNewtError(err)
+		return fmt.Errorf("%w: rc=%d", ErrBackendUpload, res.Status())
 	}
 
-	return globalXport, nil
+	return nil
 }
 
-func buildSesnCfg() (sesn.SesnCfg, error) {
-	sc := sesn.NewSesnCfg()
-	cp := globalP
-	switch cp.Type {
-	case config.CONN_TYPE_SERIAL_PLAIN:
-		sc.MgmtProto = sesn.MGMT_PROTO_NMP
-		return sc, nil
-	default:
-		return sc, util.FmtNewtError("Unknown connection type: %s (%d)",
-			config.ConnTypeToString(cp.Type), int(cp.Type))
+func (d *Device) resetRunCmd(args []string) error {
+	s, err := d.session()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBackendReset, err)
 	}
-}
 
-func stopXport() {
-	if globalXportSet {
-		// Don't attempt to close a serial transport.  Attempting to close
-		// the serial port while a read is in progress (in MacOS) just
-		// blocks until the read completes.  Instead, let the OS close the
-		// port on termination.
-		globalXport.Stop()
+	c := xact.NewResetCmd()
+	var opt = sesn.TxOptions{
+		Timeout: time.Duration(5 * float64(time.Second)),
+		Tries:   2,
 	}
-}
+	c.SetTxOptions(opt)
 
-func closeSesn() {
-	if globalSesn != nil {
-		globalSesn.Close()
+	if _, err := c.Run(s); err != nil {
+		return fmt.Errorf("%w: %v", ErrBackendReset, err)
 	}
-}
 
-func cleanup() {
-	closeSesn()
-	stopXport()
+	return nil
 }
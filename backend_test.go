@@ -0,0 +1,359 @@
+package mcumgrsvc
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jonathanyhliang/mcumgr-svc/mcuboot"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendContext(t *testing.T) {
+	b := NewMCUMgrBackend(DeviceEntry{Bid: "board-01"}, "")
+
+	// Nothing serves requests until Run runs.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, b.Reset(ctx))
+	_, err := b.VerifyImage(ctx, 0, []byte{1})
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	close(b.(*mcumgrBackend).done)
+	_, err = b.ListImages(context.Background())
+	assert.Equal(t, ErrBackendClosed, err)
+}
+
+func TestMergeContext(t *testing.T) {
+	other, cancelOther := context.WithCancel(context.Background())
+	ctx, cancel := mergeContext(context.Background(), other)
+	defer cancel()
+
+	assert.Nil(t, ctx.Err())
+	cancelOther()
+	<-ctx.Done()
+	assert.Equal(t, context.Canceled, ctx.Err())
+	assert.Equal(t, context.Canceled, sleep(ctx, time.Hour))
+}
+
+// TestBackendUploadRetry checks an upload failing midway is retried from the
+// offset the device acknowledged rather than from the start.
+func TestBackendUploadRetry(t *testing.T) {
+	img := testImageBody(bytes.Repeat([]byte("firmware"), 1024))
+	parsed, err := mcuboot.Parse(img)
+	assert.Nil(t, err)
+	d := newSMPDevice("1.0.0", bytes.Repeat([]byte{1}, 32))
+	d.fail = len(img) / 2
+	b, _ := runBackend(t, DeviceEntry{Bid: "board-01", Type: ConnTypeUdp, Addr: d.serve(t)})
+
+	assert.Nil(t, b.UploadImage(context.Background(), bytes.NewReader(img), int64(len(img)), UploadOptions{MaxWinSz: 1}))
+	assert.Eventually(t, func() bool {
+		return b.State().Status().State == StateDone
+	}, 30*time.Second, 10*time.Millisecond)
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	assert.Equal(t, parsed.Hash, d.slots[0].Hash)
+	assert.Equal(t, 1, countOffset(d.uploads, 0))
+	// The chunk rejected is the one the retry resumes with.
+	i := 0
+	for i < len(d.uploads) && d.uploads[i] < len(img)/2 {
+		i++
+	}
+	assert.Less(t, i+1, len(d.uploads))
+	assert.Equal(t, d.uploads[i], d.uploads[i+1])
+}
+
+// TestBackendUploadResumeTimeout checks a resumed upload timing out keeps the
+// offset the device acknowledged rather than starting over.
+func TestBackendUploadResumeTimeout(t *testing.T) {
+	defer func(d time.Duration) { uploadTimeout = d }(uploadTimeout)
+	uploadTimeout = 100 * time.Millisecond
+	img := testImageBody(bytes.Repeat([]byte("firmware"), 1024))
+	parsed, err := mcuboot.Parse(img)
+	assert.Nil(t, err)
+	d := newSMPDevice("1.0.0", bytes.Repeat([]byte{1}, 32))
+	// Both tries of the chunk are lost on the first upload, then on the
+	// resumed one.
+	d.fail, d.drop = len(img)/2, 4
+	b, _ := runBackend(t, DeviceEntry{Bid: "board-01", Type: ConnTypeUdp, Addr: d.serve(t)})
+
+	assert.Nil(t, b.UploadImage(context.Background(), bytes.NewReader(img), int64(len(img)), UploadOptions{MaxWinSz: 1}))
+	assert.Eventually(t, func() bool {
+		return b.State().Status().State == StateDone
+	}, 30*time.Second, 10*time.Millisecond)
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	assert.Equal(t, parsed.Hash, d.slots[0].Hash)
+	assert.Equal(t, 1, countOffset(d.uploads, 0))
+	i := 0
+	for i < len(d.uploads) && d.uploads[i] < len(img)/2 {
+		i++
+	}
+	assert.Less(t, i, len(d.uploads))
+	assert.Equal(t, 5, countOffset(d.uploads, d.uploads[i]))
+}
+
+// TestBackendBusyUpload checks resets and device commands fail right away
+// while an upload is running, rather than wait for it.
+func TestBackendBusyUpload(t *testing.T) {
+	defer func(d time.Duration) { uploadTimeout = d }(uploadTimeout)
+	uploadTimeout = 100 * time.Millisecond
+	img := testImageBody(bytes.Repeat([]byte("firmware"), 1024))
+	d := newSMPDevice("1.0.0", bytes.Repeat([]byte{1}, 32))
+	// The upload stalls half way for as long as the test runs.
+	d.fail, d.drop = len(img)/2, 1000
+	b, _ := runBackend(t, DeviceEntry{Bid: "board-01", Type: ConnTypeUdp, Addr: d.serve(t)})
+
+	uctx, cancel := context.WithCancel(context.Background())
+	assert.Nil(t, b.UploadImage(uctx, bytes.NewReader(img), int64(len(img)), UploadOptions{MaxWinSz: 1}))
+	assert.Eventually(t, func() bool {
+		d.mtx.Lock()
+		defer d.mtx.Unlock()
+		return d.off >= len(img)/2
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, PortBusy, b.PortState())
+
+	ctx, stop := context.WithTimeout(context.Background(), time.Second)
+	defer stop()
+	_, err := b.ListImages(ctx)
+	assert.Equal(t, ErrBackendBusy, err)
+	assert.Equal(t, ErrBackendBusy, b.Reset(ctx))
+
+	cancel()
+	assert.Eventually(t, func() bool {
+		return b.State().Status().State == StateFailed
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, PortOwned, b.PortState())
+	_, err = b.ListImages(ctx)
+	assert.Nil(t, err)
+}
+
+// TestBackendCanceledCommand checks a command whose context is done by the
+// time Run takes it isn't run.
+func TestBackendCanceledCommand(t *testing.T) {
+	d := newSMPDevice("1.0.0", bytes.Repeat([]byte{1}, 32))
+	b, _ := runBackend(t, DeviceEntry{Bid: "board-01", Type: ConnTypeUdp, Addr: d.serve(t)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var ran int32
+	for i := 0; i < 50; i++ {
+		err := b.exec(ctx, func(ctx context.Context, d *Device) error {
+			atomic.AddInt32(&ran, 1)
+			return nil
+		})
+		assert.Equal(t, context.Canceled, err)
+	}
+	// Commands are run in turn, so those above were handled by now.
+	_, err := b.ListImages(context.Background())
+	assert.Nil(t, err)
+	assert.Zero(t, atomic.LoadInt32(&ran))
+}
+
+// TestBackendUploadRestart checks an upload the device can't resume, e.g.
+// after it rebooted, starts over.
+func TestBackendUploadRestart(t *testing.T) {
+	img := testImageBody(bytes.Repeat([]byte("firmware"), 1024))
+	parsed, err := mcuboot.Parse(img)
+	assert.Nil(t, err)
+	d := newSMPDevice("1.0.0", bytes.Repeat([]byte{1}, 32))
+	b, _ := runBackend(t, DeviceEntry{Bid: "board-01", Type: ConnTypeUdp, Addr: d.serve(t)})
+
+	b.SetUploadOffset(parsed.Hash, 512)
+	assert.Nil(t, b.UploadImage(context.Background(), bytes.NewReader(img), int64(len(img)), UploadOptions{}))
+	assert.Eventually(t, func() bool {
+		return b.State().Status().State == StateDone
+	}, 30*time.Second, 10*time.Millisecond)
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	assert.Equal(t, 512, d.uploads[0])
+	assert.Equal(t, 1, countOffset(d.uploads, 0))
+	assert.Equal(t, parsed.Hash, d.slots[0].Hash)
+	assert.Equal(t, uint32(0), b.uploadOff(hex.EncodeToString(parsed.Hash)))
+}
+
+func countOffset(offs []int, off int) int {
+	n := 0
+	for _, o := range offs {
+		if o == off {
+			n++
+		}
+	}
+	return n
+}
+
+// TestBackendResetAfterUpload checks the device can be reset once an update
+// went through, the port being left idle rather than in use.
+func TestBackendResetAfterUpload(t *testing.T) {
+	ctx := context.Background()
+	img := testImage()
+	d := newSMPDevice("1.0.0", bytes.Repeat([]byte{1}, 32))
+	b, _ := runBackend(t, DeviceEntry{Bid: "board-01", Type: ConnTypeUdp, Addr: d.serve(t)})
+
+	assert.Nil(t, b.UploadImage(ctx, bytes.NewReader(img), int64(len(img)), UploadOptions{}))
+	assert.Eventually(t, func() bool {
+		return b.State().Status().State == StateDone
+	}, 30*time.Second, 10*time.Millisecond)
+	assert.Nil(t, b.Reset(ctx))
+	assert.Nil(t, b.Reset(ctx))
+	assert.Equal(t, PortOwned, b.port.State())
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	assert.Equal(t, 3, d.resets)
+}
+
+// stoppedHandover is a handover whose connection is lost for good.
+type stoppedHandover struct {
+	*LocalHandover
+	err error
+}
+
+func (h stoppedHandover) Run(ctx context.Context, handle func(ctx context.Context, m PortMessage) error) error {
+	return h.err
+}
+
+func TestBackendHandoverStopped(t *testing.T) {
+	for _, err := range []error{errors.New("Handover: broker gone"), nil} {
+		b := NewMCUMgrBackendHandover(DeviceEntry{Bid: "board-01", Type: ConnTypeUdp, Addr: "127.0.0.1:1337"},
+			stoppedHandover{NewLocalHandover(false), err})
+		ran := make(chan error)
+		go func() {
+			ran <- b.Run(context.Background())
+		}()
+		select {
+		case got := <-ran:
+			if err == nil {
+				err = ErrHandoverClosed
+			}
+			assert.Equal(t, err, got)
+			assert.Equal(t, err, b.LastError())
+		case <-time.After(time.Second):
+			t.Fatal("Run kept running without a handover")
+		}
+	}
+}
+
+// panicHandover is a handover panicking on Run, or on Publish once the port
+// is requested.
+type panicHandover struct {
+	*LocalHandover
+	onPublish bool
+}
+
+func (h panicHandover) Run(ctx context.Context, handle func(ctx context.Context, m PortMessage) error) error {
+	if !h.onPublish {
+		panic("handover gone mad")
+	}
+	handle(ctx, PortMessage{Type: PortRequest, Owner: "slcan-svc"})
+	return nil
+}
+
+func (h panicHandover) Publish(ctx context.Context, m PortMessage) error {
+	panic("handover gone mad")
+}
+
+// TestBackendPanic checks a panic in the handover, or in the loop of Run,
+// fails Run rather than the process.
+func TestBackendPanic(t *testing.T) {
+	for _, onPublish := range []bool{false, true} {
+		e := DeviceEntry{Bid: "board-01", Type: ConnTypeUdp, Addr: "127.0.0.1:1337",
+			Handover: HandoverConfig{Peer: "slcan-svc"}}
+		b := NewMCUMgrBackendHandover(e, panicHandover{NewLocalHandover(false), onPublish})
+		ran := make(chan error)
+		go func() {
+			ran <- b.Run(context.Background())
+		}()
+		select {
+		case err := <-ran:
+			assert.ErrorIs(t, err, ErrBackendPanic)
+			assert.ErrorIs(t, b.LastError(), ErrBackendPanic)
+		case <-time.After(time.Second):
+			t.Fatal("Run kept running after a panic")
+		}
+	}
+}
+
+// brokerHandover stands in for a broker handover, which can't publish with a
+// done context, or once Run returned and the connection is closed.
+type brokerHandover struct {
+	*LocalHandover
+	stopped atomic.Bool
+}
+
+func (h *brokerHandover) Run(ctx context.Context, handle func(ctx context.Context, m PortMessage) error) error {
+	defer h.stopped.Store(true)
+	return h.LocalHandover.Run(ctx, handle)
+}
+
+func (h *brokerHandover) Publish(ctx context.Context, m PortMessage) error {
+	if ctx.Err() != nil || h.stopped.Load() {
+		return ErrHandoverClosed
+	}
+	return h.LocalHandover.Publish(ctx, m)
+}
+
+// TestBackendShutdownRelease checks the port is handed back to the peer when
+// Run is shut down holding it.
+func TestBackendShutdownRelease(t *testing.T) {
+	h := &brokerHandover{LocalHandover: NewLocalHandover(true)}
+	pub, stop := h.Published()
+	defer stop()
+	e := DeviceEntry{Bid: "board-01", Type: ConnTypeUdp, Addr: "127.0.0.1:1337",
+		Handover: HandoverConfig{Peer: "slcan-svc"}}
+	b := NewMCUMgrBackendHandover(e, h)
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := make(chan error)
+	go func() {
+		ran <- b.Run(ctx)
+	}()
+	assert.Eventually(t, func() bool {
+		return b.PortState() == PortOwned
+	}, time.Second, time.Millisecond)
+
+	cancel()
+	assert.Nil(t, <-ran)
+	assert.Equal(t, PortReleased, b.PortState())
+	select {
+	case m := <-pub:
+		assert.Equal(t, PortMessage{Type: PortRelease, Device: "board-01", Owner: DefaultPortOwner}, m)
+	default:
+		t.Fatal("port not released on shutdown")
+	}
+}
+
+// TestBackendKeysBeforeRun checks uploads scheduled before Run are held to the
+// keys of the entry, and that keys which can't be loaded fail uploads and Run.
+func TestBackendKeysBeforeRun(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	assert.Nil(t, err)
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	assert.Nil(t, err)
+	key := filepath.Join(t.TempDir(), "key.pem")
+	assert.Nil(t, os.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644))
+	img := testImage()
+
+	e := DeviceEntry{Bid: "board-01", Type: ConnTypeUdp, Addr: "127.0.0.1:1337", Keys: []string{key}}
+	b := NewMCUMgrBackendHandover(e, NewLocalHandover(false))
+	assert.Equal(t, mcuboot.ErrImageUnsigned,
+		b.UploadImage(context.Background(), bytes.NewReader(img), int64(len(img)), UploadOptions{}))
+	assert.Equal(t, StateIdle, b.State().Status().State)
+
+	assert.Nil(t, os.WriteFile(key, []byte("not a key"), 0644))
+	b = NewMCUMgrBackendHandover(e, NewLocalHandover(false))
+	assert.Equal(t, mcuboot.ErrKeyFormat,
+		b.UploadImage(context.Background(), bytes.NewReader(img), int64(len(img)), UploadOptions{}))
+	assert.Equal(t, mcuboot.ErrKeyFormat, b.Run(context.Background()))
+}
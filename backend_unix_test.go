@@ -0,0 +1,44 @@
+//go:build unix
+
+package mcumgrsvc
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func cpuTime(t *testing.T) time.Duration {
+	var ru syscall.Rusage
+	assert.Nil(t, syscall.Getrusage(syscall.RUSAGE_SELF, &ru))
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// TestBackendIdle checks an idle backend blocks rather than spins, so it
+// takes next to no CPU time.
+func TestBackendIdle(t *testing.T) {
+	b := NewMCUMgrBackendHandover(DeviceEntry{Bid: "board-01", Type: ConnTypeUdp, Addr: "127.0.0.1:1337"},
+		NewLocalHandover(true))
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := make(chan error)
+	go func() {
+		ran <- b.Run(ctx)
+	}()
+
+	const idle = 500 * time.Millisecond
+	begin := cpuTime(t)
+	time.Sleep(idle)
+	used := cpuTime(t) - begin
+	assert.Less(t, int64(used), int64(idle/5), "idle backend used %s of CPU time", used)
+
+	cancel()
+	select {
+	case err := <-ran:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Run didn't return once its context was done")
+	}
+}
@@ -0,0 +1,275 @@
+package mcumgrsvc
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrCacheDir        = errors.New("Cache: invalid cache directory")
+	ErrDownloadStalled = errors.New("Cache: download stalled")
+)
+
+// Download retry defaults of a Cache.
+const (
+	DefaultDownloadRetries     = 5
+	DefaultDownloadBackoff     = time.Second
+	DefaultDownloadIdleTimeout = 30 * time.Second
+	maxDownloadBackoff         = time.Minute
+)
+
+// DownloadFunc requests an artifact from offset off on. It returns the body
+// and the offset the body actually starts at, which is 0 when the server
+// doesn't support range requests.
+type DownloadFunc func(ctx context.Context, off int64) (io.ReadCloser, int64, error)
+
+// Cache keeps downloaded artifacts on disk, named after their SHA256, so
+// images can be mapped rather than read for upload, and an artifact shared by
+// several devices is only downloaded once. Interrupted downloads are kept
+// alongside as ".part" files and resumed.
+type Cache struct {
+	// Retries is the number of times a failed download is resumed before
+	// Fetch gives up.
+	Retries int
+	// Backoff is the wait before the first retry, doubled on every retry
+	// up to a minute.
+	Backoff time.Duration
+	// IdleTimeout is how long a download may go without receiving data
+	// before it is given up as stalled and resumed, or 0 for ever.
+	IdleTimeout time.Duration
+
+	dir string
+	mtx sync.Mutex
+	// locks holds a semaphore per SHA256 of an artifact being fetched.
+	locks map[string]chan struct{}
+}
+
+// NewCache returns a Cache keeping its files in dir, which is created if
+// needed.
+func NewCache(dir string) (*Cache, error) {
+	if dir == "" {
+		return nil, ErrCacheDir
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Cache{
+		Retries:     DefaultDownloadRetries,
+		Backoff:     DefaultDownloadBackoff,
+		IdleTimeout: DefaultDownloadIdleTimeout,
+		dir:         dir,
+		locks:       make(map[string]chan struct{}),
+	}, nil
+}
+
+func (c *Cache) path(sha256 string) string {
+	return filepath.Join(c.dir, strings.ToLower(sha256))
+}
+
+// lock serialises fetches of the artifact with the given SHA256, so devices
+// deployed the same artifact don't write the same partial download. It returns
+// the function unlocking it, or the error of ctx if it is done first.
+func (c *Cache) lock(ctx context.Context, sha256 string) (func(), error) {
+	c.mtx.Lock()
+	l, ok := c.locks[strings.ToLower(sha256)]
+	if !ok {
+		l = make(chan struct{}, 1)
+		c.locks[strings.ToLower(sha256)] = l
+	}
+	c.mtx.Unlock()
+	select {
+	case l <- struct{}{}:
+		return func() { <-l }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Open returns the cached artifact with the given SHA256, or an error
+// satisfying errors.Is(err, fs.ErrNotExist) if it isn't cached.
+func (c *Cache) Open(sha256 string) (*os.File, error) {
+	if sha256 == "" {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(c.path(sha256))
+}
+
+// Fetch returns the artifact a from the cache, downloading it with download
+// unless it is there already. A download that fails is resumed from where it
+// stopped, after a growing backoff, up to c.Retries times; if a advertises its
+// SHA256, so is one interrupted by a restart. A download receiving nothing for
+// c.IdleTimeout fails with ErrDownloadStalled and is resumed likewise. progress,
+// if set, is called with the number of bytes downloaded so far as the download
+// goes.
+func (c *Cache) Fetch(ctx context.Context, a Artifact, download DownloadFunc, progress func(n int64)) (*os.File, error) {
+	unlock, err := c.lock(ctx, a.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if f, err := c.Open(a.SHA256); err == nil {
+		return f, nil
+	}
+
+	var part *os.File
+	if a.SHA256 != "" {
+		part, err = os.OpenFile(c.path(a.SHA256)+".part", os.O_RDWR|os.O_CREATE, 0644)
+	} else {
+		part, err = os.CreateTemp(c.dir, ".download-*")
+		if err == nil {
+			defer os.Remove(part.Name())
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer part.Close()
+
+	backoff := c.Backoff
+	for try := 0; ; try++ {
+		err = resumeDownload(ctx, part, a, download, c.IdleTimeout, progress)
+		if err == nil {
+			break
+		}
+		if try >= c.Retries || ctx.Err() != nil {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxDownloadBackoff {
+			backoff = maxDownloadBackoff
+		}
+	}
+
+	f, err := c.commit(part, a)
+	if err != nil {
+		// Whatever was downloaded is bad, start over next time.
+		os.Remove(part.Name())
+	}
+	return f, err
+}
+
+// resumeDownload appends the rest of the artifact a to the partial download
+// part, failing with ErrDownloadStalled once nothing came in for idle.
+func resumeDownload(ctx context.Context, part *os.File, a Artifact, download DownloadFunc,
+	idle time.Duration, progress func(n int64)) error {
+	off, err := part.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if a.Size != 0 && off >= int64(a.Size) {
+		return nil
+	}
+
+	r, start, err := download(ctx, off)
+	if err != nil {
+		return err
+	}
+	if idle > 0 {
+		r = newIdleReader(r, idle)
+	}
+	defer r.Close()
+	if start > off {
+		return ErrArtifactMissing
+	}
+	if start < off {
+		// The server didn't honour the range, drop what it sends again.
+		if err := part.Truncate(start); err != nil {
+			return err
+		}
+		if _, err := part.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	w := io.Writer(part)
+	if progress != nil {
+		w = &progressWriter{w: part, n: start, fn: progress}
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// commit checks the downloaded artifact f against the size and hashes
+// advertised for it and moves it into the cache, returning the cached file.
+func (c *Cache) commit(f *os.File, a Artifact) (*os.File, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	h := newArtifactHasher()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	if err := a.check(h); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+
+	p := c.path(hex.EncodeToString(h.sha256.Sum(nil)))
+	if err := os.Rename(f.Name(), p); err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+// progressWriter reports the running total of the bytes written through it.
+type progressWriter struct {
+	w  io.Writer
+	n  int64
+	fn func(n int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.n += int64(n)
+	p.fn(p.n)
+	return n, err
+}
+
+// idleReader fails the reads of a body which went without data for timeout,
+// by closing it, which also unblocks the read in flight.
+type idleReader struct {
+	r       io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	stalled atomic.Bool
+}
+
+func newIdleReader(r io.ReadCloser, timeout time.Duration) *idleReader {
+	ir := &idleReader{r: r, timeout: timeout}
+	ir.timer = time.AfterFunc(timeout, func() {
+		ir.stalled.Store(true)
+		r.Close()
+	})
+	return ir
+}
+
+func (r *idleReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if r.stalled.Load() {
+		return n, ErrDownloadStalled
+	}
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+func (r *idleReader) Close() error {
+	r.timer.Stop()
+	return r.r.Close()
+}
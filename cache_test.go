@@ -0,0 +1,160 @@
+package mcumgrsvc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyReader fails once n bytes were read.
+type flakyReader struct {
+	r io.Reader
+	n int
+}
+
+func (f *flakyReader) Read(p []byte) (int, error) {
+	if f.n == 0 {
+		return 0, errors.New("connection reset")
+	}
+	if len(p) > f.n {
+		p = p[:f.n]
+	}
+	n, err := f.r.Read(p)
+	f.n -= n
+	return n, err
+}
+
+func TestCacheFetch(t *testing.T) {
+	c, err := NewCache(t.TempDir())
+	assert.Nil(t, err)
+	c.Backoff = time.Millisecond
+
+	a := Artifact{
+		Size:   len("firmware"),
+		SHA256: "c3bf47ea1f4a4a605470313cacb3a44f4a461f68c6faeab07e737610cb5ac835",
+	}
+	downloads := 0
+	download := func(s string) DownloadFunc {
+		return func(ctx context.Context, off int64) (io.ReadCloser, int64, error) {
+			downloads++
+			return io.NopCloser(strings.NewReader(s[off:])), off, nil
+		}
+	}
+
+	_, err = c.Fetch(context.Background(), a, download("firmwarE"), nil)
+	assert.True(t, errors.Is(err, ErrArtifactHash))
+	_, err = c.Open(a.SHA256)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	for i := 0; i < 2; i++ {
+		f, err := c.Fetch(context.Background(), a, download("firmware"), nil)
+		assert.Nil(t, err)
+		b, _ := io.ReadAll(f)
+		f.Close()
+		assert.Equal(t, "firmware", string(b))
+	}
+	assert.Equal(t, 2, downloads)
+}
+
+func TestCacheFetchResume(t *testing.T) {
+	c, err := NewCache(t.TempDir())
+	assert.Nil(t, err)
+	c.Backoff = time.Millisecond
+
+	a := Artifact{
+		Size:   len("firmware"),
+		SHA256: "c3bf47ea1f4a4a605470313cacb3a44f4a461f68c6faeab07e737610cb5ac835",
+	}
+
+	// The connection drops after 3 bytes, then the download resumes from there.
+	var offs []int64
+	var progress int64
+	f, err := c.Fetch(context.Background(), a, func(ctx context.Context, off int64) (io.ReadCloser, int64, error) {
+		offs = append(offs, off)
+		return io.NopCloser(&flakyReader{strings.NewReader("firmware"[off:]), 3}), off, nil
+	}, func(n int64) { progress = n })
+	assert.Nil(t, err)
+	f.Close()
+	assert.Equal(t, []int64{0, 3, 6}, offs)
+	assert.Equal(t, int64(len("firmware")), progress)
+
+	// A server ignoring the range sends the whole artifact again.
+	os.Remove(c.path(a.SHA256))
+	offs = nil
+	_, err = c.Fetch(context.Background(), a, func(ctx context.Context, off int64) (io.ReadCloser, int64, error) {
+		offs = append(offs, off)
+		if len(offs) == 1 {
+			return io.NopCloser(&flakyReader{strings.NewReader("firmware"), 5}), 0, nil
+		}
+		return io.NopCloser(strings.NewReader("firmware")), 0, nil
+	}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{0, 5}, offs)
+
+	// Fetch gives up after c.Retries.
+	os.Remove(c.path(a.SHA256))
+	c.Retries = 1
+	_, err = c.Fetch(context.Background(), a, func(ctx context.Context, off int64) (io.ReadCloser, int64, error) {
+		return nil, 0, errors.New("unreachable")
+	}, nil)
+	assert.EqualError(t, err, "unreachable")
+}
+
+func TestCacheFetchStalled(t *testing.T) {
+	c, err := NewCache(t.TempDir())
+	assert.Nil(t, err)
+	c.Backoff = time.Millisecond
+	c.IdleTimeout = 10 * time.Millisecond
+
+	a := Artifact{
+		Size:   len("firmware"),
+		SHA256: "c3bf47ea1f4a4a605470313cacb3a44f4a461f68c6faeab07e737610cb5ac835",
+	}
+
+	// The connection hangs after 3 bytes without dropping, and is resumed
+	// from there once idle for too long.
+	var offs []int64
+	f, err := c.Fetch(context.Background(), a, func(ctx context.Context, off int64) (io.ReadCloser, int64, error) {
+		offs = append(offs, off)
+		if off != 0 {
+			return io.NopCloser(strings.NewReader("firmware"[off:])), off, nil
+		}
+		r, w := io.Pipe()
+		go w.Write([]byte("fir"))
+		return r, off, nil
+	}, nil)
+	assert.Nil(t, err)
+	f.Close()
+	assert.Equal(t, []int64{0, 3}, offs)
+}
+
+func TestCacheFetchLock(t *testing.T) {
+	c, err := NewCache(t.TempDir())
+	assert.Nil(t, err)
+	a := Artifact{SHA256: "c3bf47ea1f4a4a605470313cacb3a44f4a461f68c6faeab07e737610cb5ac835"}
+
+	// A fetch waiting for another one of the same artifact gives up once its
+	// context is done.
+	unlock, err := c.lock(context.Background(), a.SHA256)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = c.Fetch(ctx, a, func(ctx context.Context, off int64) (io.ReadCloser, int64, error) {
+		t.Fatal("fetched a locked artifact")
+		return nil, 0, nil
+	}, nil)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	unlock()
+	f, err := c.Fetch(context.Background(), a, func(ctx context.Context, off int64) (io.ReadCloser, int64, error) {
+		return io.NopCloser(strings.NewReader("firmware")), 0, nil
+	}, nil)
+	assert.Nil(t, err)
+	f.Close()
+}
@@ -1,7 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	hawkbit "github.com/jonathanyhliang/hawkbit-fota/backend"
+	mcumgrsvc "github.com/jonathanyhliang/mcumgr-svc"
+	"github.com/jonathanyhliang/mcumgr-svc/mcuboot"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -12,3 +22,238 @@ func TestParseDeployBsaeHref(t *testing.T) {
 	assert.Equal(t, "bid-1234", bid)
 	assert.Equal(t, "acid-5678", acid)
 }
+
+func TestParseCancelActionHref(t *testing.T) {
+	u := "/default/controller/v1/bid-1234/cancelAction/acid-5678"
+	bid, acid := parseCancelActionHref(u)
+	assert.Equal(t, "bid-1234", bid)
+	assert.Equal(t, "acid-5678", acid)
+}
+
+func TestSuperviseDevice(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runs := 0
+	superviseDevice(ctx, func() {
+		runs++
+		if runs == 1 {
+			// Don't wait out the restart interval.
+			defer cancel()
+			panic("board-01 hung up")
+		}
+	}, log.NewNopLogger())
+	assert.Equal(t, 1, runs)
+
+	// A loop returning early is restarted too.
+	defer func(d time.Duration) { restartInterval = d }(restartInterval)
+	restartInterval = time.Millisecond
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	runs = 0
+	var buf bytes.Buffer
+	superviseDevice(ctx, func() {
+		if runs++; runs == 2 {
+			cancel()
+		}
+	}, log.NewLogfmtLogger(&buf))
+	assert.Equal(t, 2, runs)
+	assert.Contains(t, buf.String(), "device=restarted after=return")
+
+	// The log tells a restart after a panic apart.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	runs = 0
+	buf.Reset()
+	superviseDevice(ctx, func() {
+		if runs++; runs == 2 {
+			cancel()
+			return
+		}
+		panic("board-01 hung up")
+	}, log.NewLogfmtLogger(&buf))
+	assert.Equal(t, 2, runs)
+	assert.Contains(t, buf.String(), "device=restarted after=panic")
+	assert.True(t, runRecovered(func() { panic("again") }, log.NewNopLogger()))
+}
+
+type installedService struct {
+	mcumgrsvc.IService
+	ib  hawkbit.DeploymentBase
+	err error
+}
+
+func (s installedService) GetInstalledBase(ctx context.Context, bid, acid string) (hawkbit.DeploymentBase, error) {
+	return s.ib, s.err
+}
+
+type installedBackend struct {
+	mcumgrsvc.Backend
+	port   mcumgrsvc.PortState
+	slots  []mcumgrsvc.ImageSlot
+	listed int
+}
+
+func (b *installedBackend) PortState() mcumgrsvc.PortState {
+	return b.port
+}
+
+func (b *installedBackend) ListImages(ctx context.Context) ([]mcumgrsvc.ImageSlot, error) {
+	b.listed++
+	return b.slots, nil
+}
+
+func TestInstalled(t *testing.T) {
+	ctx := context.Background()
+	e := mcumgrsvc.DeviceEntry{Bid: "board-01"}
+	var dp hawkbit.DeploymentBase
+	dp.ID = "7"
+	dp.Deployment.Chunks[0].Version = "1.1.0"
+	running := func(ver string) []mcumgrsvc.ImageSlot {
+		return []mcumgrsvc.ImageSlot{{Version: ver, Active: true}}
+	}
+
+	// Hawkbit knows best.
+	b := &installedBackend{port: mcumgrsvc.PortOwned, slots: running("1.1.0")}
+	assert.True(t, installed(ctx, installedService{ib: dp}, b, e, "7", dp, log.NewNopLogger()))
+	assert.False(t, installed(ctx, installedService{ib: dp}, b, e, "8", dp, log.NewNopLogger()))
+	assert.Equal(t, 0, b.listed)
+
+	// Otherwise the board is asked, provided its port is ours.
+	svc := installedService{err: mcumgrsvc.ErrNotInstalled}
+	assert.True(t, installed(ctx, svc, b, e, "7", dp, log.NewNopLogger()))
+	assert.Equal(t, 1, b.listed)
+	b.slots = running("1.0.0")
+	assert.False(t, installed(ctx, svc, b, e, "7", dp, log.NewNopLogger()))
+	b.slots = running("1.1.0")
+	for _, port := range []mcumgrsvc.PortState{mcumgrsvc.PortReleased, mcumgrsvc.PortBusy} {
+		b.port, b.listed = port, 0
+		assert.False(t, installed(ctx, svc, b, e, "7", dp, log.NewNopLogger()))
+		assert.Equal(t, 0, b.listed)
+	}
+
+	// A deployment without a version can't be matched.
+	b.port, b.listed = mcumgrsvc.PortOwned, 0
+	assert.False(t, installed(ctx, svc, b, e, "7", hawkbit.DeploymentBase{}, log.NewNopLogger()))
+	assert.Equal(t, 0, b.listed)
+}
+
+func TestImageDetails(t *testing.T) {
+	img := &mcuboot.Image{
+		Header: mcuboot.Header{Version: mcuboot.Version{Major: 1, Minor: 2, Revision: 3}},
+		Hash:   []byte{0xde, 0xad},
+	}
+	assert.Equal(t, []string{"image version 1.2.3", "image hash dead", "image unsigned"}, imageDetails(img))
+
+	img.Header.Flags = mcuboot.FlagEncryptedAES256
+	img.TLVs = []mcuboot.TLV{{Type: mcuboot.TLVECDSASig}, {Type: mcuboot.TLVED25519}}
+	img.Dependencies = []mcuboot.Dependency{{ImageID: 1, MinVersion: mcuboot.Version{Major: 2}}}
+	assert.Equal(t, []string{"image version 1.2.3", "image hash dead", "image signed with ECDSA_P256, ED25519",
+		"image encrypted", "image depends on image 1 version 2.0.0 or later"}, imageDetails(img))
+}
+
+func TestCancelable(t *testing.T) {
+	store, err := mcumgrsvc.NewStore(t.TempDir())
+	assert.Nil(t, err)
+	assert.False(t, cancelable(store, "board-01", ""))
+
+	// An action the board never started can be canceled.
+	assert.True(t, cancelable(store, "board-01", "7"))
+
+	// So can one postponed or interrupted, and one canceled already,
+	// but not one installed or failed.
+	for st, ok := range map[mcumgrsvc.State]bool{
+		mcumgrsvc.StateIdle:      true,
+		mcumgrsvc.StateUploading: true,
+		mcumgrsvc.StateDone:      false,
+		mcumgrsvc.StateFailed:    false,
+	} {
+		assert.Nil(t, store.Save("board-01", mcumgrsvc.Deployment{Acid: "7", State: st}))
+		assert.Equal(t, ok, cancelable(store, "board-01", "7"), st)
+		assert.True(t, cancelable(store, "board-01", "8"), st)
+	}
+	assert.Nil(t, store.Save("board-01", mcumgrsvc.Deployment{Acid: "7", State: mcumgrsvc.StateFailed,
+		Err: errCanceled.Error()}))
+	assert.True(t, cancelable(store, "board-01", "7"))
+}
+
+// cancelService is a Hawkbit server offering the cancel action cacid, which
+// stops the action stopID, unless cacid is empty. The first fails fetches of
+// the cancel action fail.
+type cancelService struct {
+	mcumgrsvc.IService
+	mtx           sync.Mutex
+	cacid, stopID string
+	fails         int
+	fbs           []hawkbit.CancelActionFeedback
+}
+
+func (s *cancelService) GetController(ctx context.Context, bid string) (hawkbit.Controller, error) {
+	var ctrlr hawkbit.Controller
+	if s.cacid != "" {
+		ctrlr.Links.CancelAction.Href = "/default/controller/v1/" + bid + "/cancelAction/" + s.cacid
+	}
+	return ctrlr, nil
+}
+
+func (s *cancelService) GetCancelAction(ctx context.Context, bid, acid string) (mcumgrsvc.CancelAction, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var ca mcumgrsvc.CancelAction
+	if s.fails > 0 {
+		s.fails--
+		return ca, errors.New("hawkbit unreachable")
+	}
+	ca.ID = acid
+	ca.CancelAction.StopID = s.stopID
+	return ca, nil
+}
+
+func (s *cancelService) PostCancelActionFeedback(ctx context.Context, bid string, fb hawkbit.CancelActionFeedback) error {
+	s.fbs = append(s.fbs, fb)
+	return nil
+}
+
+// TestCancelUpdate checks a cancel action for the action being deployed stops
+// its update, and is confirmed unless the update went through first.
+func TestCancelUpdate(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		cacid, stopID string
+		fails         int
+		// done is whether the update went through before it stopped.
+		done    bool
+		stopped bool
+		fb      string
+	}{
+		{name: "canceled", cacid: "12", stopID: "7", stopped: true, fb: "closed"},
+		{name: "fetch retried", cacid: "12", stopID: "7", fails: 2, stopped: true, fb: "closed"},
+		{name: "too late", cacid: "12", stopID: "7", done: true, stopped: true, fb: "rejected"},
+		{name: "other action", cacid: "12", stopID: "8"},
+		{name: "none", stopID: "7"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc := &cancelService{cacid: tc.cacid, stopID: tc.stopID, fails: tc.fails}
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			stopped := false
+			cancels := watchCancel(ctx, svc, "board-01", "7", time.Millisecond, func() { stopped = true },
+				log.NewNopLogger())
+
+			cacid, ok := <-cancels
+			assert.Equal(t, tc.stopped, ok)
+			assert.Equal(t, tc.stopped, stopped)
+			if !ok {
+				assert.Empty(t, svc.fbs)
+				return
+			}
+			assert.Equal(t, tc.cacid, cacid)
+			_, ok = <-cancels
+			assert.False(t, ok)
+
+			assert.Nil(t, postCancelFeedback(context.Background(), svc, "board-01", cacid, !tc.done, log.NewNopLogger()))
+			assert.Len(t, svc.fbs, 1)
+			assert.Equal(t, cacid, svc.fbs[0].ID)
+			assert.Equal(t, tc.fb, svc.fbs[0].Status.Execution)
+		})
+	}
+}
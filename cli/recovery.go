@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	mcumgrsvc "github.com/jonathanyhliang/mcumgr-svc"
+)
+
+// Where deployments are recorded and artifacts cached unless told otherwise.
+// Both have to survive reboots, or an update a reboot interrupted is neither
+// resumed nor is its download.
+const (
+	defaultStateDir = "/var/lib/mcumgr-svc"
+	defaultCacheDir = "/var/cache/mcumgr-svc"
+)
+
+// userStateDir returns where the user's deployments are recorded, following
+// the XDG base directory specification.
+func userStateDir() (string, error) {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "mcumgr-svc"), nil
+}
+
+// userCacheDir returns where the user's artifacts are cached.
+func userCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "mcumgr-svc"), nil
+}
+
+// persistentDir returns dir if given. Otherwise it returns sys if it can be
+// written, e.g. when running as root, or else the user's directory fn returns,
+// warning that it is used instead.
+func persistentDir(dir, sys string, fn func() (string, error), logger log.Logger) string {
+	if dir != "" {
+		return dir
+	}
+	if writable(sys) {
+		return sys
+	}
+	usr, err := fn()
+	if err != nil {
+		// Let creating it report why it can't be written.
+		return sys
+	}
+	logger.Log("warn", sys+" not writable, using "+usr+" instead")
+	return usr
+}
+
+// writable reports whether files can be created in dir, creating it if need
+// be.
+func writable(dir string) bool {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false
+	}
+	f, err := os.CreateTemp(dir, ".probe-")
+	if err != nil {
+		return false
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return true
+}
+
+// recoverDeployment picks up the deployment of the board bid recorded by the
+// last run. An interrupted update is reported to Hawkbit as being resumed, as
+// its action is still open and offered again, and the outcome of a finished
+// one Hawkbit never heard of is reported. It returns the ID of the action
+// recorded as finished, which isn't to be deployed again, or "".
+func recoverDeployment(ctx context.Context, svc mcumgrsvc.IService, store *mcumgrsvc.Store, bid string,
+	logger log.Logger) string {
+	rec, err := store.Load(bid)
+	if err != nil {
+		logger.Log("err", err)
+	}
+	switch {
+	case rec.Interrupted():
+		logger.Log("action", rec.Acid, "interrupted", rec.State, "offset", rec.Offset)
+		var fb mcumgrsvc.DeploymentBaseFeedback
+		fb.ID = rec.Acid
+		fb.Status.Execution, fb.Status.Result.Finished = "proceeding", "none"
+		fb.Status.Details = []string{"resuming update interrupted while " + rec.State.String()}
+		if err := svc.PostDeployBaseFeedback(ctx, bid, fb); err != nil {
+			logger.Log("err", err)
+		}
+	case rec.State.Terminal():
+		if !rec.Reported {
+			st := rec.Status()
+			recordStatus(store, bid, rec.Acid, st, postFeedback(ctx, svc, bid, rec.Acid, st, logger) == nil, logger)
+		}
+		return rec.Acid
+	}
+	return ""
+}
+
+// resumeOffset returns the offset the upload of the artifact of the given
+// SHA256 for the action acid got to before a restart, or 0 if the board
+// recorded another deployment.
+func resumeOffset(store *mcumgrsvc.Store, bid, acid, sha256 string) int64 {
+	d, err := store.Load(bid)
+	if err != nil || d.Acid != acid || d.SHA256 != sha256 {
+		return 0
+	}
+	return d.Offset
+}
+
+// How often recordUpdate records the upload offset.
+const recordInterval = time.Second
+
+// recordUpdate records the update of the artifact a for the action acid as it
+// goes through the states sent on changes and uploads the bytes sent on
+// events, until both are closed. How the update ends is left to the caller,
+// so one aborted on exit is found interrupted on restart.
+func recordUpdate(store *mcumgrsvc.Store, bid, acid string, a mcumgrsvc.Artifact,
+	changes <-chan mcumgrsvc.Status, events <-chan mcumgrsvc.Progress, logger log.Logger) {
+	var last time.Time
+	for changes != nil || events != nil {
+		var fn func(d *mcumgrsvc.Deployment)
+		select {
+		case st, ok := <-changes:
+			if !ok {
+				changes = nil
+				continue
+			}
+			if st.State == mcumgrsvc.StateIdle || st.State.Terminal() {
+				continue
+			}
+			fn = func(d *mcumgrsvc.Deployment) {
+				d.State, d.Prev, d.Since = st.State, st.Prev, st.Since
+				switch st.State {
+				case mcumgrsvc.StateDownloading, mcumgrsvc.StateScheduled, mcumgrsvc.StateUploading:
+				default:
+					// The image is on the device.
+					d.Offset = 0
+				}
+			}
+		case p, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if time.Since(last) < recordInterval {
+				continue
+			}
+			last = time.Now()
+			fn = func(d *mcumgrsvc.Deployment) {
+				if d.State == mcumgrsvc.StateUploading {
+					d.Offset = p.Sent
+				}
+			}
+		}
+		err := store.Update(bid, func(d *mcumgrsvc.Deployment) {
+			if d.Acid != acid || d.SHA256 != a.SHA256 {
+				*d = mcumgrsvc.Deployment{Acid: acid, SHA256: a.SHA256}
+			}
+			d.Err, d.Reported = "", false
+			fn(d)
+		})
+		if err != nil {
+			logger.Log("err", err)
+		}
+	}
+}
+
+// recordStatus records st as the status of the action acid, which Hawkbit was
+// told about if reported.
+func recordStatus(store *mcumgrsvc.Store, bid, acid string, st mcumgrsvc.Status, reported bool, logger log.Logger) {
+	err := store.Update(bid, func(d *mcumgrsvc.Deployment) {
+		if d.Acid != acid {
+			*d = mcumgrsvc.Deployment{Acid: acid}
+		}
+		d.State, d.Prev, d.Since = st.State, st.Prev, st.Since
+		d.Err = ""
+		if st.Err != nil {
+			d.Err = st.Err.Error()
+		}
+		d.Reported = reported
+	})
+	if err != nil {
+		logger.Log("err", err)
+	}
+}
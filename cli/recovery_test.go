@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	mcumgrsvc "github.com/jonathanyhliang/mcumgr-svc"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type feedbackService struct {
+	mcumgrsvc.IService
+	fbs []mcumgrsvc.DeploymentBaseFeedback
+	err error
+}
+
+func (s *feedbackService) PostDeployBaseFeedback(ctx context.Context, bid string, fb mcumgrsvc.DeploymentBaseFeedback) error {
+	s.fbs = append(s.fbs, fb)
+	return s.err
+}
+
+func TestRecoverInterrupted(t *testing.T) {
+	store, err := mcumgrsvc.NewStore(t.TempDir())
+	assert.Nil(t, err)
+	rec := mcumgrsvc.Deployment{Acid: "7", SHA256: "abcd", State: mcumgrsvc.StateUploading,
+		Prev: mcumgrsvc.StateScheduled, Offset: 512, Since: time.Now()}
+	assert.Nil(t, store.Save("board-01", rec))
+
+	svc := &feedbackService{}
+	assert.Equal(t, "", recoverDeployment(context.Background(), svc, store, "board-01", log.NewNopLogger()))
+	assert.Len(t, svc.fbs, 1)
+	assert.Equal(t, "7", svc.fbs[0].ID)
+	assert.Equal(t, "proceeding", svc.fbs[0].Status.Execution)
+	assert.Equal(t, "none", svc.fbs[0].Status.Result.Finished)
+
+	// The upload resumes where it stopped, for the same action and artifact
+	// only.
+	assert.Equal(t, int64(512), resumeOffset(store, "board-01", "7", "abcd"))
+	assert.Equal(t, int64(0), resumeOffset(store, "board-01", "8", "abcd"))
+	assert.Equal(t, int64(0), resumeOffset(store, "board-01", "7", "ef01"))
+	assert.Equal(t, int64(0), resumeOffset(store, "board-02", "7", "abcd"))
+}
+
+func TestRecoverUnreported(t *testing.T) {
+	ctx := context.Background()
+	store, err := mcumgrsvc.NewStore(t.TempDir())
+	assert.Nil(t, err)
+	rec := mcumgrsvc.Deployment{Acid: "7", State: mcumgrsvc.StateFailed, Prev: mcumgrsvc.StateUploading,
+		Err: "upload failed", Since: time.Now()}
+	assert.Nil(t, store.Save("board-01", rec))
+
+	// A failed report is tried again on the next start.
+	svc := &feedbackService{err: errors.New("hawkbit down")}
+	assert.Equal(t, "7", recoverDeployment(ctx, svc, store, "board-01", log.NewNopLogger()))
+	assert.Len(t, svc.fbs, 1)
+	d, err := store.Load("board-01")
+	assert.Nil(t, err)
+	assert.False(t, d.Reported)
+
+	svc = &feedbackService{}
+	assert.Equal(t, "7", recoverDeployment(ctx, svc, store, "board-01", log.NewNopLogger()))
+	assert.Len(t, svc.fbs, 1)
+	assert.Equal(t, "closed", svc.fbs[0].Status.Execution)
+	assert.Equal(t, "failure", svc.fbs[0].Status.Result.Finished)
+	assert.Equal(t, []string{"update failed while uploading", "upload failed"}, svc.fbs[0].Status.Details)
+	d, err = store.Load("board-01")
+	assert.Nil(t, err)
+	assert.True(t, d.Reported)
+	assert.Equal(t, mcumgrsvc.StateFailed, d.State)
+
+	// Once reported, it is left alone.
+	svc = &feedbackService{}
+	assert.Equal(t, "7", recoverDeployment(ctx, svc, store, "board-01", log.NewNopLogger()))
+	assert.Empty(t, svc.fbs)
+}
+
+func TestRecordUpdate(t *testing.T) {
+	store, err := mcumgrsvc.NewStore(t.TempDir())
+	assert.Nil(t, err)
+	a := mcumgrsvc.Artifact{SHA256: "abcd"}
+	changes := make(chan mcumgrsvc.Status)
+	events := make(chan mcumgrsvc.Progress)
+	recorded := make(chan struct{})
+	go func() {
+		defer close(recorded)
+		recordUpdate(store, "board-01", "7", a, changes, events, log.NewNopLogger())
+	}()
+
+	changes <- mcumgrsvc.Status{State: mcumgrsvc.StateUploading, Prev: mcumgrsvc.StateScheduled}
+	events <- mcumgrsvc.Progress{Sent: 512, Total: 1024}
+	close(events)
+	close(changes)
+	<-recorded
+	d, err := store.Load("board-01")
+	assert.Nil(t, err)
+	assert.Equal(t, mcumgrsvc.Deployment{Acid: "7", SHA256: "abcd", State: mcumgrsvc.StateUploading,
+		Prev: mcumgrsvc.StateScheduled, Offset: 512}, d)
+	assert.True(t, d.Interrupted())
+
+	recordStatus(store, "board-01", "7", mcumgrsvc.Status{State: mcumgrsvc.StateDone, Prev: mcumgrsvc.StateResetting},
+		true, log.NewNopLogger())
+	d, err = store.Load("board-01")
+	assert.Nil(t, err)
+	assert.Equal(t, mcumgrsvc.StateDone, d.State)
+	assert.True(t, d.Reported)
+	assert.False(t, d.Interrupted())
+}
+
+func TestPersistentDir(t *testing.T) {
+	usr := func() (string, error) { return "/home/user/.cache/mcumgr-svc", nil }
+	assert.Equal(t, "/given", persistentDir("/given", "/sys", usr, log.NewNopLogger()))
+
+	sys := filepath.Join(t.TempDir(), "mcumgr-svc")
+	assert.Equal(t, sys, persistentDir("", sys, usr, log.NewNopLogger()))
+	assert.DirExists(t, sys)
+
+	// A directory that can't be created, under a file.
+	file := filepath.Join(t.TempDir(), "file")
+	assert.Nil(t, os.WriteFile(file, nil, 0644))
+	assert.Equal(t, "/home/user/.cache/mcumgr-svc", persistentDir("", filepath.Join(file, "mcumgr-svc"), usr, log.NewNopLogger()))
+
+	none := func() (string, error) { return "", errors.New("no home") }
+	assert.Equal(t, filepath.Join(file, "mcumgr-svc"), persistentDir("", filepath.Join(file, "mcumgr-svc"), none, log.NewNopLogger()))
+}
+
+func TestUserStateDir(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", "/xdg/state")
+	dir, err := userStateDir()
+	assert.Nil(t, err)
+	assert.Equal(t, "/xdg/state/mcumgr-svc", dir)
+
+	t.Setenv("XDG_STATE_HOME", "")
+	t.Setenv("HOME", "/home/user")
+	dir, err = userStateDir()
+	assert.Nil(t, err)
+	assert.Equal(t, "/home/user/.local/state/mcumgr-svc", dir)
+}
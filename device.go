@@ -0,0 +1,226 @@
+package mcumgrsvc
+
+import (
+	"context"
+	"sync"
+
+	"mynewt.apache.org/newt/util"
+	"mynewt.apache.org/newtmgr/newtmgr/config"
+	"mynewt.apache.org/newtmgr/nmxact/nmcoap"
+	"mynewt.apache.org/newtmgr/nmxact/nmserial"
+	"mynewt.apache.org/newtmgr/nmxact/sesn"
+	"mynewt.apache.org/newtmgr/nmxact/udp"
+	"mynewt.apache.org/newtmgr/nmxact/xport"
+)
+
+type coapFilter struct {
+	tx nmcoap.TxMsgFilter
+	rx nmcoap.RxMsgFilter
+}
+
+var coapFilters = make(map[string]coapFilter)
+var coapFiltersMtx sync.RWMutex
+
+// RegisterCoapFilters makes a pair of CoAP Tx/Rx message filters available to
+// OIC devices under name. Either filter may be nil.
+func RegisterCoapFilters(name string, txFilter nmcoap.TxMsgFilter, rxFilter nmcoap.RxMsgFilter) {
+	coapFiltersMtx.Lock()
+	defer coapFiltersMtx.Unlock()
+	coapFilters[name] = coapFilter{tx: txFilter, rx: rxFilter}
+}
+
+func lookupCoapFilters(name string) (nmcoap.TxMsgFilter, nmcoap.RxMsgFilter, bool) {
+	coapFiltersMtx.RLock()
+	defer coapFiltersMtx.RUnlock()
+	f, ok := coapFilters[name]
+	return f.tx, f.rx, ok
+}
+
+// Device keeps the connection profile, transport and session used to talk to
+// a single MCU. The transport and session are created lazily on first use and
+// torn down by Close, so a Device can be reopened after the port has been
+// handed over to another service.
+type Device struct {
+	p        *config.ConnProfile
+	xport    xport.Xport
+	sesn     sesn.Sesn
+	txFilter nmcoap.TxMsgFilter
+	rxFilter nmcoap.RxMsgFilter
+	mtx      sync.Mutex
+}
+
+// NewDevice returns a Device for the connection profile described by args,
+// e.g. []string{"acm", "type=serial", "connstring=dev=/dev/ttyACM0"} or
+// []string{"eth", "type=udp", "connstring=192.168.1.10:1337"}.
+func NewDevice(args []string) (*Device, error) {
+	cp, err := connProfileAddCmd(args)
+	if err != nil {
+		return nil, err
+	}
+	return &Device{p: cp}, nil
+}
+
+// Name returns the name of the device connection profile.
+func (d *Device) Name() string {
+	return d.p.Name
+}
+
+// SetFilters sets the CoAP Tx/Rx message filters applied to OIC sessions of
+// the device. It takes effect the next time the session is opened.
+func (d *Device) SetFilters(txFilter nmcoap.TxMsgFilter, rxFilter nmcoap.RxMsgFilter) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.txFilter = txFilter
+	d.rxFilter = rxFilter
+}
+
+// Open starts the transport and opens a session to the device. Opening an
+// already open device is a no-op.
+func (d *Device) Open() error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	_, err := d.getSesn()
+	return err
+}
+
+// Close closes the session and stops the transport of the device.
+func (d *Device) Close() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.cleanup()
+}
+
+// abortOn closes the device once ctx is done, which fails the command in
+// flight. The returned function stops watching ctx, returning once the device
+// is closed if it was, so the close never hits the session of the next command.
+func (d *Device) abortOn(ctx context.Context) func() {
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			d.Close()
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// session returns the open session of the device, opening it if required.
+func (d *Device) session() (sesn.Sesn, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.getSesn()
+}
+
+func (d *Device) getSesn() (sesn.Sesn, error) {
+	if d.sesn != nil {
+		return d.sesn, nil
+	}
+
+	sc, err := d.buildSesnCfg()
+	if err != nil {
+		return nil, err
+	}
+	sc.TxFilter = d.txFilter
+	sc.RxFilter = d.rxFilter
+
+	x, err := d.getXport()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := x.BuildSesn(sc)
+	if err != nil {
+		return nil, util.ChildNewtError(err)
+	}
+
+	if err := s.Open(); err != nil {
+		return nil, util.ChildNewtError(err)
+	}
+	d.sesn = s
+
+	return d.sesn, nil
+}
+
+func (d *Device) getXport() (xport.Xport, error) {
+	if d.xport != nil {
+		return d.xport, nil
+	}
+
+	var x xport.Xport
+	cp := d.p
+	switch cp.Type {
+	case config.CONN_TYPE_SERIAL_PLAIN, config.CONN_TYPE_SERIAL_OIC:
+		sc, err := config.ParseSerialConnString(cp.ConnString)
+		if err != nil {
+			return nil, err
+		}
+
+		x = nmserial.NewSerialXport(sc)
+	case config.CONN_TYPE_UDP_PLAIN, config.CONN_TYPE_UDP_OIC:
+		x = udp.NewUdpXport()
+	default:
+		return nil, util.FmtNewtError("Unknown connection type: %s (%d)",
+			config.ConnTypeToString(cp.Type), int(cp.Type))
+	}
+
+	if err := x.Start(); err != nil {
+		return nil, util.ChildNewtError(err)
+	}
+	d.xport = x
+
+	return d.xport, nil
+}
+
+func (d *Device) buildSesnCfg() (sesn.SesnCfg, error) {
+	sc := sesn.NewSesnCfg()
+	cp := d.p
+	switch cp.Type {
+	case config.CONN_TYPE_SERIAL_PLAIN:
+		sc.MgmtProto = sesn.MGMT_PROTO_NMP
+		return sc, nil
+	case config.CONN_TYPE_SERIAL_OIC:
+		sc.MgmtProto = sesn.MGMT_PROTO_OMP
+		return sc, nil
+	case config.CONN_TYPE_UDP_PLAIN:
+		var err error
+		sc.MgmtProto = sesn.MGMT_PROTO_NMP
+		sc.PeerSpec.Udp, err = config.ParseUdpConnString(cp.ConnString)
+		return sc, err
+	case config.CONN_TYPE_UDP_OIC:
+		var err error
+		sc.MgmtProto = sesn.MGMT_PROTO_OMP
+		sc.PeerSpec.Udp, err = config.ParseUdpConnString(cp.ConnString)
+		return sc, err
+	default:
+		return sc, util.FmtNewtError("Unknown connection type: %s (%d)",
+			config.ConnTypeToString(cp.Type), int(cp.Type))
+	}
+}
+
+func (d *Device) stopXport() {
+	if d.xport != nil {
+		// Don't attempt to close a serial transport.  Attempting to close
+		// the serial port while a read is in progress (in MacOS) just
+		// blocks until the read completes.  Instead, let the OS close the
+		// port on termination.
+		d.xport.Stop()
+		d.xport = nil
+	}
+}
+
+func (d *Device) closeSesn() {
+	if d.sesn != nil {
+		d.sesn.Close()
+		d.sesn = nil
+	}
+}
+
+func (d *Device) cleanup() {
+	d.closeSesn()
+	d.stopXport()
+}
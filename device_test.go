@@ -0,0 +1,299 @@
+package mcumgrsvc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/jonathanyhliang/mcumgr-svc/mcuboot"
+	"github.com/stretchr/testify/assert"
+	"github.com/ugorji/go/codec"
+	"mynewt.apache.org/newtmgr/nmxact/sesn"
+)
+
+func TestNewDevice(t *testing.T) {
+	d0, err := NewDevice([]string{"acm0", "type=serial", "connstring=dev=/dev/ttyACM0,baud=115200"})
+	assert.Nil(t, err)
+	d1, err := NewDevice([]string{"acm1", "type=serial", "connstring=dev=/dev/ttyACM1,baud=115200"})
+	assert.Nil(t, err)
+	assert.Equal(t, "acm0", d0.Name())
+	assert.Equal(t, "acm1", d1.Name())
+	assert.Equal(t, "dev=/dev/ttyACM0,baud=115200", d0.p.ConnString)
+	assert.Equal(t, "dev=/dev/ttyACM1,baud=115200", d1.p.ConnString)
+
+	_, err = NewDevice([]string{"acm2", "type=bogus"})
+	assert.Equal(t, ErrBackendPort, err)
+	_, err = NewDevice([]string{"acm3"})
+	assert.Equal(t, ErrBackendPort, err)
+}
+
+func TestDeviceSesnCfg(t *testing.T) {
+	for _, tc := range []struct {
+		args  []string
+		proto sesn.MgmtProto
+		udp   bool
+	}{
+		{[]string{"acm", "type=serial", "connstring=dev=/dev/ttyACM0"}, sesn.MGMT_PROTO_NMP, false},
+		{[]string{"acm", "type=oic_serial", "connstring=dev=/dev/ttyACM0"}, sesn.MGMT_PROTO_OMP, false},
+		{[]string{"eth", "type=udp", "connstring=127.0.0.1:1337"}, sesn.MGMT_PROTO_NMP, true},
+		{[]string{"eth", "type=oic_udp", "connstring=127.0.0.1:5683"}, sesn.MGMT_PROTO_OMP, true},
+	} {
+		d, err := NewDevice(tc.args)
+		assert.Nil(t, err)
+		sc, err := d.buildSesnCfg()
+		assert.Nil(t, err)
+		assert.Equal(t, tc.proto, sc.MgmtProto)
+		assert.Equal(t, tc.udp, sc.PeerSpec.Udp != nil)
+	}
+}
+
+func TestRegisterCoapFilters(t *testing.T) {
+	RegisterCoapFilters("none", nil, nil)
+	_, _, ok := lookupCoapFilters("none")
+	assert.True(t, ok)
+	_, _, ok = lookupCoapFilters("bogus")
+	assert.False(t, ok)
+}
+
+// smpResponder answers every SMP request received on a local UDP socket with an
+// empty success response, enough to stand in for Zephyr's SMP UDP server.
+func smpResponder(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 8 {
+				continue
+			}
+			// Echo the request header back as a write response carrying
+			// {"rc": 0}.
+			body := []byte{0xa1, 0x62, 'r', 'c', 0x00}
+			rsp := append([]byte{}, buf[:8]...)
+			rsp[0] = 3
+			binary.BigEndian.PutUint16(rsp[2:4], uint16(len(body)))
+			conn.WriteTo(append(rsp, body...), addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestDeviceUdp(t *testing.T) {
+	addr := smpResponder(t)
+	d, err := NewDevice([]string{"eth", "type=udp", "connstring=" + addr})
+	assert.Nil(t, err)
+	defer d.Close()
+
+	assert.Nil(t, d.Open())
+	assert.Nil(t, d.resetRunCmd([]string{}))
+}
+
+// smpDevice emulates the image management and reset of an MCUboot device
+// behind Zephyr's SMP UDP server, well enough to run the backend against.
+type smpDevice struct {
+	mtx   sync.Mutex
+	slots []ImageSlot
+	// data is the image being uploaded, of which off bytes are received.
+	data []byte
+	off  int
+	// revert makes the device come back up running the image it ran before
+	// a reset, as if the image under test failed to boot.
+	revert bool
+	// fail has the upload chunk at or past offset fail rejected, once, or
+	// left unanswered drop times, as if the link lost it.
+	fail int
+	drop int
+	// recovery has uploads written straight to slot 0, as MCUboot does in
+	// serial recovery mode.
+	recovery bool
+	// uploads are the offsets of the upload requests received.
+	uploads []int
+	resets  int
+}
+
+// newSMPDevice returns a device running an image of the given version and
+// hash, confirmed in slot 0.
+func newSMPDevice(version string, hash []byte) *smpDevice {
+	return &smpDevice{slots: []ImageSlot{{
+		Version: version, Hash: hash, Bootable: true, Confirmed: true, Active: true,
+	}}}
+}
+
+// cborHandle encodes and decodes the bodies of SMP messages. Maps decode to
+// map[string]interface{}, and unsigned integers to uint64.
+var cborHandle = func() *codec.CborHandle {
+	h := &codec.CborHandle{}
+	h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	return h
+}()
+
+// serve answers the SMP requests received on a local UDP socket, returning
+// its address.
+func (d *smpDevice) serve(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 8 {
+				continue
+			}
+			hdr := append([]byte{}, buf[:8]...)
+			var req map[string]interface{}
+			if err := codec.NewDecoderBytes(buf[8:n], cborHandle).Decode(&req); err != nil || req == nil {
+				req = map[string]interface{}{}
+			}
+			rsp := d.handle(hdr[0], binary.BigEndian.Uint16(hdr[4:6]), hdr[7], req)
+			if rsp == nil {
+				continue
+			}
+			var body []byte
+			codec.NewEncoderBytes(&body, cborHandle).MustEncode(rsp)
+			hdr[0]++
+			binary.BigEndian.PutUint16(hdr[2:4], uint16(len(body)))
+			conn.WriteTo(append(hdr, body...), addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// handle answers a request of the given op, group and command ID, or returns
+// nil to leave it unanswered.
+func (d *smpDevice) handle(op uint8, group uint16, id uint8, req map[string]interface{}) map[string]interface{} {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	switch {
+	case group == 0 && id == 5:
+		d.reset()
+		return map[string]interface{}{"rc": 0}
+	case group == 1 && id == 0 && op == 0:
+		return d.state()
+	case group == 1 && id == 0:
+		hash, _ := req["hash"].([]byte)
+		confirm, _ := req["confirm"].(bool)
+		if !d.mark(hash, confirm) {
+			return map[string]interface{}{"rc": 3}
+		}
+		return d.state()
+	case group == 1 && id == 1:
+		return d.upload(req)
+	case group == 1 && id == 5:
+		d.slots, d.data = d.slots[:1], nil
+		return map[string]interface{}{"rc": 0}
+	}
+	return map[string]interface{}{"rc": 8}
+}
+
+func (d *smpDevice) state() map[string]interface{} {
+	images := make([]interface{}, 0, len(d.slots))
+	for _, s := range d.slots {
+		images = append(images, map[string]interface{}{
+			"image": s.Image, "slot": s.Slot, "version": s.Version, "hash": s.Hash,
+			"bootable": s.Bootable, "pending": s.Pending, "confirmed": s.Confirmed,
+			"active": s.Active, "permanent": s.Permanent,
+		})
+	}
+	return map[string]interface{}{"rc": 0, "images": images}
+}
+
+// mark marks the image of the given hash for test, or confirms it, reporting
+// whether there is such an image. An empty hash confirms the active image.
+func (d *smpDevice) mark(hash []byte, confirm bool) bool {
+	for i := range d.slots {
+		s := &d.slots[i]
+		if len(hash) == 0 && confirm && s.Active || len(hash) != 0 && bytes.Equal(s.Hash, hash) {
+			switch {
+			case s.Active:
+				s.Confirmed = confirm || s.Confirmed
+			case confirm:
+				s.Pending, s.Permanent = true, true
+			default:
+				s.Pending = true
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// reset boots the image pending in slot 1, unless told to revert.
+func (d *smpDevice) reset() {
+	d.resets++
+	d.data = nil
+	if len(d.slots) < 2 || !d.slots[1].Pending {
+		return
+	}
+	if d.revert {
+		d.slots[1].Pending = false
+		return
+	}
+	old, cur := d.slots[0], d.slots[1]
+	d.slots[0] = ImageSlot{Version: cur.Version, Hash: cur.Hash, Bootable: true,
+		Confirmed: cur.Permanent, Active: true}
+	d.slots[1] = ImageSlot{Slot: 1, Version: old.Version, Hash: old.Hash, Bootable: true}
+}
+
+// upload takes a chunk of an image upload the way Zephyr does: a request at
+// offset 0 carrying the length starts over, a chunk at another offset than
+// expected is answered with the offset expected, and chunks without an upload
+// in progress are rejected.
+func (d *smpDevice) upload(req map[string]interface{}) map[string]interface{} {
+	off, _ := req["off"].(uint64)
+	data, _ := req["data"].([]byte)
+	d.uploads = append(d.uploads, int(off))
+	if d.fail != 0 && int(off) >= d.fail {
+		if d.drop > 0 {
+			if d.drop--; d.drop == 0 {
+				d.fail = 0
+			}
+			return nil
+		}
+		d.fail = 0
+		return map[string]interface{}{"rc": 1}
+	}
+	if n, ok := req["len"].(uint64); ok && off == 0 {
+		d.data, d.off = make([]byte, n), 0
+		if len(d.slots) > 1 {
+			d.slots = d.slots[:1]
+		}
+	}
+	if d.data == nil {
+		return map[string]interface{}{"rc": 3}
+	}
+	if int(off) != d.off || d.off+len(data) > len(d.data) {
+		return map[string]interface{}{"rc": 0, "off": d.off}
+	}
+	d.off += copy(d.data[d.off:], data)
+	if d.off == len(d.data) {
+		if img, err := mcuboot.Parse(d.data); err == nil && d.recovery {
+			d.slots[0] = ImageSlot{Version: img.Header.Version.String(), Hash: img.Hash,
+				Bootable: true, Confirmed: true, Active: true}
+		} else if err == nil {
+			d.slots = append(d.slots[:1], ImageSlot{Slot: 1, Version: img.Header.Version.String(),
+				Hash: img.Hash, Bootable: true})
+		}
+		d.data = nil
+	}
+	return map[string]interface{}{"rc": 0, "off": d.off}
+}
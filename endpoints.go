@@ -2,6 +2,7 @@ package mcumgrsvc
 
 import (
 	"context"
+	"io"
 
 	hawkbit "github.com/jonathanyhliang/hawkbit-fota/backend"
 
@@ -9,11 +10,14 @@ import (
 )
 
 type Endpoints struct {
-	GetControllerEndpoint          endpoint.Endpoint
-	PutConfigDataEndpoint          endpoint.Endpoint
-	GetDeployBaseEndpoint          endpoint.Endpoint
-	PostDeployBaseFeedbackEndpoint endpoint.Endpoint
-	GetDownloadHttpEndpoint        endpoint.Endpoint
+	GetControllerEndpoint            endpoint.Endpoint
+	PutConfigDataEndpoint            endpoint.Endpoint
+	GetDeployBaseEndpoint            endpoint.Endpoint
+	PostDeployBaseFeedbackEndpoint   endpoint.Endpoint
+	GetDownloadHttpStreamEndpoint    endpoint.Endpoint
+	GetInstalledBaseEndpoint         endpoint.Endpoint
+	GetCancelActionEndpoint          endpoint.Endpoint
+	PostCancelActionFeedbackEndpoint endpoint.Endpoint
 }
 
 func (e Endpoints) GetController(ctx context.Context, bid string) (hawkbit.Controller, error) {
@@ -43,8 +47,8 @@ func (e Endpoints) GetDeployBase(ctx context.Context, bid, acid string) (hawkbit
 	return response.Dp, response.Err
 }
 
-func (e Endpoints) PostDeployBaseFeedback(ctx context.Context, bid string, fb hawkbit.DeploymentBaseFeedback) error {
-	resp, err := e.PostDeployBaseFeedbackEndpoint(ctx, hawkbit.PostDeploymentBaseFeedbackRequest{Bid: bid, Fb: fb})
+func (e Endpoints) PostDeployBaseFeedback(ctx context.Context, bid string, fb DeploymentBaseFeedback) error {
+	resp, err := e.PostDeployBaseFeedbackEndpoint(ctx, PostDeployBaseFeedbackRequest{Bid: bid, Fb: fb})
 	if err != nil {
 		return err
 	}
@@ -52,11 +56,87 @@ func (e Endpoints) PostDeployBaseFeedback(ctx context.Context, bid string, fb ha
 	return response.Err
 }
 
-func (e Endpoints) GetDownloadHttp(ctx context.Context, bid, ver string) []byte {
-	resp, err := e.GetDownloadHttpEndpoint(ctx, hawkbit.GetDownloadHttpRequest{Bid: bid, Ver: ver})
+// GetDownloadHttpStream requests the artifact from offset off on and returns
+// its body along with the offset the body starts at, which is 0 if the server
+// doesn't support range requests.
+func (e Endpoints) GetDownloadHttpStream(ctx context.Context, bid, ver string, off int64) (io.ReadCloser, int64, error) {
+	resp, err := e.GetDownloadHttpStreamEndpoint(ctx, GetDownloadHttpStreamRequest{Bid: bid, Ver: ver, Off: off})
 	if err != nil {
-		return nil
+		return nil, 0, err
 	}
-	response := resp.(hawkbit.GetDownloadHttpResponse)
-	return response.File
+	response := resp.(GetDownloadHttpStreamResponse)
+	return response.Body, response.Off, nil
+}
+
+// GetInstalledBase returns the deployment of the action acid if it is the one
+// last installed on the device, and ErrNotInstalled otherwise.
+func (e Endpoints) GetInstalledBase(ctx context.Context, bid, acid string) (hawkbit.DeploymentBase, error) {
+	resp, err := e.GetInstalledBaseEndpoint(ctx, GetInstalledBaseRequest{Bid: bid, Acid: acid})
+	if err != nil {
+		return hawkbit.DeploymentBase{}, err
+	}
+	response := resp.(GetInstalledBaseResponse)
+	return response.Ib, response.Err
+}
+
+func (e Endpoints) GetCancelAction(ctx context.Context, bid, acid string) (CancelAction, error) {
+	resp, err := e.GetCancelActionEndpoint(ctx, GetCancelActionRequest{Bid: bid, Acid: acid})
+	if err != nil {
+		return CancelAction{}, err
+	}
+	response := resp.(GetCancelActionResponse)
+	return response.Ca, nil
+}
+
+func (e Endpoints) PostCancelActionFeedback(ctx context.Context, bid string, fb hawkbit.CancelActionFeedback) error {
+	resp, err := e.PostCancelActionFeedbackEndpoint(ctx, hawkbit.PostCancelActionFeedbackRequest{Bid: bid, Fb: fb})
+	if err != nil {
+		return err
+	}
+	response := resp.(hawkbit.PostCancelActionFeedbackResponse)
+	return response.Err
+}
+
+type PostDeployBaseFeedbackRequest struct {
+	Bid string
+	Fb  DeploymentBaseFeedback
+}
+
+// GetDownloadHttpStreamRequest asks for the artifact from offset Off on.
+type GetDownloadHttpStreamRequest struct {
+	Bid string
+	Ver string
+	Off int64
+}
+
+// GetDownloadHttpStreamResponse holds the body of an artifact download, which
+// the caller reads and closes, and the offset it starts at.
+type GetDownloadHttpStreamResponse struct {
+	Body io.ReadCloser
+	Off  int64
+}
+
+// GetInstalledBaseRequest asks for the deployment of the action Acid, if it is
+// the one installed.
+type GetInstalledBaseRequest struct {
+	Bid  string
+	Acid string
+}
+
+// GetInstalledBaseResponse holds the installed deployment as the DDI API
+// returns it.
+type GetInstalledBaseResponse struct {
+	Ib  hawkbit.DeploymentBase
+	Err error
+}
+
+// GetCancelActionRequest asks for the cancel action Acid.
+type GetCancelActionRequest struct {
+	Bid  string
+	Acid string
+}
+
+// GetCancelActionResponse holds the cancel action as the DDI API returns it.
+type GetCancelActionResponse struct {
+	Ca CancelAction
 }
@@ -3,6 +3,7 @@ module github.com/jonathanyhliang/mcumgr-svc
 go 1.19
 
 require (
+	github.com/eclipse/paho.mqtt.golang v1.4.3
 	github.com/go-kit/kit v0.12.0
 	github.com/jonathanyhliang/hawkbit-fota v0.0.0-20230618113608-cea05c2727e6
 	github.com/opentracing/opentracing-go v1.2.0
@@ -10,8 +11,8 @@ require (
 	github.com/sony/gobreaker v0.4.1
 	github.com/stretchr/testify v1.8.1
 	github.com/swaggo/swag v1.16.1
+	github.com/ugorji/go/codec v1.2.11
 	golang.org/x/time v0.0.0-20210723032227-1f47c861a9ac
-	gopkg.in/cheggaaa/pb.v1 v1.0.28
 	mynewt.apache.org/newt v0.0.0-20230602182319-5c0ea32e8f97
 	mynewt.apache.org/newtmgr v0.0.0-20230307221322-e33456691c39
 )
@@ -30,6 +31,7 @@ require (
 	github.com/go-openapi/spec v0.20.6 // indirect
 	github.com/go-openapi/swag v0.19.15 // indirect
 	github.com/gorilla/mux v1.8.0 // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/joaojeronimo/go-crc16 v0.0.0-20140729130949-59bd0194935e // indirect
 	github.com/josharian/intern v1.0.0 // indirect
 	github.com/mailru/easyjson v0.7.6 // indirect
@@ -49,11 +51,12 @@ require (
 	github.com/smartystreets/goconvey v1.8.0 // indirect
 	github.com/streadway/handy v0.0.0-20200128134331-0f66f006fb2e // indirect
 	github.com/tarm/serial v0.0.0-20180830185346-98f6abe2eb07 // indirect
-	github.com/ugorji/go/codec v1.2.11 // indirect
 	golang.org/x/net v0.10.0 // indirect
+	golang.org/x/sync v0.2.0 // indirect
 	golang.org/x/sys v0.8.0 // indirect
 	golang.org/x/tools v0.7.0 // indirect
 	google.golang.org/grpc v1.40.0 // indirect
+	gopkg.in/cheggaaa/pb.v1 v1.0.28 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,193 @@
+package mcumgrsvc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// amqpHandover consumes the port arbitration messages of a device from an AMQP
+// queue. A message is only acknowledged once it is handled, and is requeued
+// otherwise. Lost connections are re-established with backoff.
+type amqpHandover struct {
+	url    string
+	cfg    HandoverConfig
+	health *handoverHealth
+
+	// ch is the channel messages are published on while connected.
+	ch struct {
+		ch  *amqp.Channel
+		mtx sync.Mutex
+	}
+}
+
+func newAMQPHandover(url string, cfg HandoverConfig) *amqpHandover {
+	return &amqpHandover{url: url, cfg: cfg, health: newHandoverHealth()}
+}
+
+// Run consumes handovers until ctx is done, reconnecting whenever the
+// connection to the broker fails.
+func (h *amqpHandover) Run(ctx context.Context, handle func(ctx context.Context, m PortMessage) error) error {
+	return reconnect(ctx, h.health, func(ctx context.Context) (bool, error) {
+		return h.consume(ctx, handle)
+	})
+}
+
+// Health returns the state of the connection to the broker.
+func (h *amqpHandover) Health() HandoverHealth {
+	return h.health.get()
+}
+
+// consume receives handovers over a single connection until it is lost or ctx
+// is done, reporting whether it got as far as consuming.
+func (h *amqpHandover) consume(ctx context.Context, handle func(ctx context.Context, m PortMessage) error) (bool, error) {
+	conn, err := amqp.Dial(h.url)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return false, err
+	}
+	defer ch.Close()
+	chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	if h.cfg.Exchange != "" {
+		err = ch.ExchangeDeclare(
+			h.cfg.Exchange, // name
+			"direct",       // kind
+			h.cfg.Durable,  // durable
+			false,          // delete when unused
+			false,          // internal
+			false,          // no-wait
+			nil,            // arguments
+		)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	q, err := ch.QueueDeclare(
+		h.cfg.Queue,   // name
+		h.cfg.Durable, // durable
+		false,         // delete when unused
+		false,         // exclusive
+		false,         // no-wait
+		nil,           // arguments
+	)
+	if err != nil {
+		return false, err
+	}
+
+	if h.cfg.Exchange != "" {
+		err = ch.QueueBind(q.Name, h.cfg.RoutingKey, h.cfg.Exchange, false, nil)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// Handle one handover at a time, so the ones left unacknowledged stay
+	// with the broker.
+	if err := ch.Qos(1, 0, false); err != nil {
+		return false, err
+	}
+
+	msgs, err := ch.Consume(
+		q.Name, // queue
+		"",     // consumer
+		false,  // auto-ack
+		false,  // exclusive
+		false,  // no-local
+		false,  // no-wait
+		nil,    // args
+	)
+	if err != nil {
+		return false, err
+	}
+	h.setChannel(ch)
+	defer h.setChannel(nil)
+	h.health.set(true, nil)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return true, nil
+		case err := <-closed:
+			return true, closeError(err)
+		case err := <-chClosed:
+			return true, closeError(err)
+		case d, ok := <-msgs:
+			if !ok {
+				return true, ErrHandoverClosed
+			}
+			if d.Body == nil {
+				d.Ack(false)
+				continue
+			}
+			m, err := ParsePortMessage(d.Body)
+			if err != nil {
+				// Nobody can make sense of it, so drop it.
+				d.Reject(false)
+				continue
+			}
+			if err := handle(ctx, m); err != nil {
+				// Leave the handover with the broker until the port
+				// can be claimed.
+				d.Nack(false, true)
+				return true, err
+			}
+			if err := d.Ack(false); err != nil {
+				return true, err
+			}
+		}
+	}
+}
+
+// Publish sends m to the peer, if there is one.
+func (h *amqpHandover) Publish(ctx context.Context, m PortMessage) error {
+	if h.cfg.Peer == "" {
+		return nil
+	}
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	h.ch.mtx.Lock()
+	defer h.ch.mtx.Unlock()
+	if h.ch.ch == nil {
+		return ErrHandoverClosed
+	}
+	mode := amqp.Transient
+	if h.cfg.Durable {
+		mode = amqp.Persistent
+	}
+	return h.ch.ch.PublishWithContext(ctx,
+		h.cfg.Exchange, // exchange
+		h.cfg.Peer,     // routing key
+		false,          // mandatory
+		false,          // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: mode,
+			Body:         body,
+		})
+}
+
+func (h *amqpHandover) setChannel(ch *amqp.Channel) {
+	h.ch.mtx.Lock()
+	defer h.ch.mtx.Unlock()
+	h.ch.ch = ch
+}
+
+func closeError(err *amqp.Error) error {
+	if err == nil {
+		return ErrHandoverClosed
+	}
+	return fmt.Errorf("%w: %v", ErrHandoverClosed, err)
+}
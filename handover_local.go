@@ -0,0 +1,79 @@
+package mcumgrsvc
+
+import (
+	"context"
+	"time"
+)
+
+// LocalHandover passes the port arbitration messages of a device within the
+// process, for gateways running without a broker and for tests. Messages are
+// handed in with Send, and the ones the backend publishes are watched with
+// Published.
+type LocalHandover struct {
+	grant     bool
+	since     time.Time
+	msgs      chan localMessage
+	published hub[PortMessage]
+}
+
+type localMessage struct {
+	m   PortMessage
+	err chan error
+}
+
+// NewLocalHandover returns a LocalHandover, granting the port as soon as it
+// runs if grant is set.
+func NewLocalHandover(grant bool) *LocalHandover {
+	return &LocalHandover{grant: grant, since: time.Now(), msgs: make(chan localMessage)}
+}
+
+// Run hands the messages sent to handle until ctx is done.
+func (h *LocalHandover) Run(ctx context.Context, handle func(ctx context.Context, m PortMessage) error) error {
+	if h.grant {
+		if err := handle(ctx, PortMessage{Type: PortGrant}); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case lm := <-h.msgs:
+			lm.err <- handle(ctx, lm.m)
+		}
+	}
+}
+
+// Send hands m to the backend, returning once it was handled. A message the
+// backend fails on is left to the caller to send again.
+func (h *LocalHandover) Send(ctx context.Context, m PortMessage) error {
+	errc := make(chan error, 1)
+	select {
+	case h.msgs <- localMessage{m: m, err: errc}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Publish hands m to the watchers of Published.
+func (h *LocalHandover) Publish(ctx context.Context, m PortMessage) error {
+	h.published.publish(m)
+	return nil
+}
+
+// Published returns a channel receiving every message published, and a
+// function to stop watching, which closes the channel.
+func (h *LocalHandover) Published() (<-chan PortMessage, func()) {
+	return h.published.subscribe()
+}
+
+// Health reports a LocalHandover as always connected.
+func (h *LocalHandover) Health() HandoverHealth {
+	return HandoverHealth{Connected: true, Since: h.since}
+}
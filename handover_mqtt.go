@@ -0,0 +1,145 @@
+package mcumgrsvc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttHandover receives the port arbitration messages of a device on an MQTT
+// topic, at QoS 1. A message is only acknowledged once it is handled; one that
+// isn't is delivered again when the session is resumed, which takes a durable
+// session. Lost connections are re-established with backoff.
+type mqttHandover struct {
+	url string
+	// clientID names the session, one per owner and device, as the broker
+	// drops a client when another connects with its ID.
+	clientID string
+	cfg      HandoverConfig
+	health   *handoverHealth
+
+	// client is the client messages are published with while connected.
+	client struct {
+		c   mqtt.Client
+		mtx sync.Mutex
+	}
+}
+
+func newMQTTHandover(url, bid string, cfg HandoverConfig) *mqttHandover {
+	return &mqttHandover{url: url, clientID: cfg.Owner + "-" + bid, cfg: cfg, health: newHandoverHealth()}
+}
+
+// Run receives handovers until ctx is done, reconnecting whenever the
+// connection to the broker fails.
+func (h *mqttHandover) Run(ctx context.Context, handle func(ctx context.Context, m PortMessage) error) error {
+	return reconnect(ctx, h.health, func(ctx context.Context) (bool, error) {
+		return h.subscribe(ctx, handle)
+	})
+}
+
+// Health returns the state of the connection to the broker.
+func (h *mqttHandover) Health() HandoverHealth {
+	return h.health.get()
+}
+
+// subscribe receives handovers over a single connection until it is lost or
+// ctx is done, reporting whether it got as far as subscribing.
+func (h *mqttHandover) subscribe(ctx context.Context, handle func(ctx context.Context, m PortMessage) error) (bool, error) {
+	lost := make(chan error, 1)
+	msgs := make(chan mqtt.Message)
+	done := make(chan struct{})
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(h.url).
+		SetClientID(h.clientID).
+		SetCleanSession(!h.cfg.Durable).
+		SetAutoReconnect(false).
+		SetAutoAckDisabled(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			select {
+			case lost <- err:
+			default:
+			}
+		})
+	c := mqtt.NewClient(opts)
+	if err := waitToken(ctx, c.Connect()); err != nil {
+		return false, err
+	}
+	defer c.Disconnect(250)
+	// Unblock the handler before disconnecting, so the client can stop.
+	defer close(done)
+
+	// Messages are handed to the loop below one at a time, like the AMQP
+	// handover does with a prefetch of one.
+	handler := func(_ mqtt.Client, m mqtt.Message) {
+		select {
+		case msgs <- m:
+		case <-done:
+		}
+	}
+	if err := waitToken(ctx, c.Subscribe(h.cfg.Queue, 1, handler)); err != nil {
+		return false, err
+	}
+	h.setClient(c)
+	defer h.setClient(nil)
+	h.health.set(true, nil)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return true, nil
+		case err := <-lost:
+			return true, fmt.Errorf("%w: %v", ErrHandoverClosed, err)
+		case msg := <-msgs:
+			m, err := ParsePortMessage(msg.Payload())
+			if err != nil {
+				// Nobody can make sense of it, so drop it.
+				msg.Ack()
+				continue
+			}
+			if err := handle(ctx, m); err != nil {
+				// Leave the handover unacknowledged until the port
+				// can be claimed.
+				return true, err
+			}
+			msg.Ack()
+		}
+	}
+}
+
+// Publish sends m to the peer, if there is one.
+func (h *mqttHandover) Publish(ctx context.Context, m PortMessage) error {
+	if h.cfg.Peer == "" {
+		return nil
+	}
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	h.client.mtx.Lock()
+	c := h.client.c
+	h.client.mtx.Unlock()
+	if c == nil {
+		return ErrHandoverClosed
+	}
+	return waitToken(ctx, c.Publish(h.cfg.Peer, 1, false, body))
+}
+
+func (h *mqttHandover) setClient(c mqtt.Client) {
+	h.client.mtx.Lock()
+	defer h.client.mtx.Unlock()
+	h.client.c = c
+}
+
+// waitToken waits for the operation of t to complete, or ctx to be done.
+func waitToken(ctx context.Context, t mqtt.Token) error {
+	select {
+	case <-t.Done():
+		return t.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
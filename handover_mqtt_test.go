@@ -0,0 +1,177 @@
+package mcumgrsvc
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+// mqttBroker is an MQTT broker just good enough for one client: it accepts
+// connections and subscriptions, delivers what is sent at QoS 1 to the topics
+// the client subscribed to, and hands what the client publishes to pub.
+type mqttBroker struct {
+	ln   net.Listener
+	pub  chan *packets.PublishPacket
+	acks chan uint16
+
+	mtx    sync.Mutex
+	conn   net.Conn
+	topics map[string]bool
+	id     uint16
+}
+
+func newMQTTBroker(t *testing.T) *mqttBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	b := &mqttBroker{ln: ln, pub: make(chan *packets.PublishPacket, 8), acks: make(chan uint16, 8),
+		topics: make(map[string]bool)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *mqttBroker) url() string {
+	return "tcp://" + b.ln.Addr().String()
+}
+
+func (b *mqttBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		p, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		var reply packets.ControlPacket
+		switch p := p.(type) {
+		case *packets.ConnectPacket:
+			b.mtx.Lock()
+			b.conn = conn
+			b.mtx.Unlock()
+			reply = packets.NewControlPacket(packets.Connack)
+		case *packets.SubscribePacket:
+			b.mtx.Lock()
+			for _, topic := range p.Topics {
+				b.topics[topic] = true
+			}
+			b.mtx.Unlock()
+			sa := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			sa.MessageID, sa.ReturnCodes = p.MessageID, p.Qoss
+			reply = sa
+		case *packets.PublishPacket:
+			b.pub <- p
+			if p.Qos > 0 {
+				pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				pa.MessageID = p.MessageID
+				reply = pa
+			}
+		case *packets.PubackPacket:
+			b.acks <- p.MessageID
+		case *packets.PingreqPacket:
+			reply = packets.NewControlPacket(packets.Pingresp)
+		case *packets.DisconnectPacket:
+			return
+		}
+		if reply != nil {
+			b.mtx.Lock()
+			reply.Write(conn)
+			b.mtx.Unlock()
+		}
+	}
+}
+
+// send delivers m to the client on topic at QoS 1, once it subscribed to it,
+// and returns the message ID the client acknowledges it with.
+func (b *mqttBroker) send(t *testing.T, topic string, m PortMessage) uint16 {
+	assert.Eventually(t, func() bool {
+		b.mtx.Lock()
+		defer b.mtx.Unlock()
+		return b.topics[topic]
+	}, 5*time.Second, time.Millisecond)
+	body, err := json.Marshal(m)
+	assert.Nil(t, err)
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.id++
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.Qos, p.MessageID, p.TopicName, p.Payload = 1, b.id, topic, body
+	assert.Nil(t, p.Write(b.conn))
+	return b.id
+}
+
+// published returns the next message the client published, and its topic.
+func (b *mqttBroker) published(t *testing.T) (string, PortMessage) {
+	select {
+	case p := <-b.pub:
+		m, err := ParsePortMessage(p.Payload)
+		assert.Nil(t, err)
+		return p.TopicName, m
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing published")
+	}
+	return "", PortMessage{}
+}
+
+func (b *mqttBroker) acked(t *testing.T, id uint16) {
+	select {
+	case got := <-b.acks:
+		assert.Equal(t, id, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not acknowledged")
+	}
+}
+
+// TestMQTTHandover checks port arbitration messages make the round trip over
+// an MQTT broker: grants and releases from the peer hand the port over, each
+// acknowledged once handled, and requests are answered on the peer's topic.
+func TestMQTTHandover(t *testing.T) {
+	broker := newMQTTBroker(t)
+	e := DeviceEntry{Bid: "board-01", Type: ConnTypeUdp, Addr: "127.0.0.1:1337",
+		Handover: HandoverConfig{Type: HandoverMQTT, Queue: "mcumgr/board-01", Peer: "slcan/board-01"}}
+	b := NewMCUMgrBackend(e, broker.url())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ran := make(chan error, 1)
+	go func() {
+		ran <- b.Run(ctx)
+	}()
+
+	id := broker.send(t, "mcumgr/board-01", PortMessage{Type: PortGrant, Device: "board-01", Owner: DefaultPortOwner})
+	broker.acked(t, id)
+	assert.Equal(t, PortOwned, b.PortState())
+	assert.True(t, b.HandoverHealth().Connected)
+
+	id = broker.send(t, "mcumgr/board-01", PortMessage{Type: PortRequest, Device: "board-01", Owner: "slcan-svc", Lease: 30})
+	topic, m := broker.published(t)
+	assert.Equal(t, "slcan/board-01", topic)
+	assert.Equal(t, PortMessage{Type: PortGrant, Device: "board-01", Owner: "slcan-svc", Lease: 30}, m)
+	broker.acked(t, id)
+	assert.Equal(t, PortReleased, b.PortState())
+
+	id = broker.send(t, "mcumgr/board-01", PortMessage{Type: PortRelease, Device: "board-01", Owner: "slcan-svc"})
+	broker.acked(t, id)
+	assert.Equal(t, PortOwned, b.PortState())
+
+	// The port is handed back on shutdown.
+	cancel()
+	assert.Nil(t, <-ran)
+	topic, m = broker.published(t)
+	assert.Equal(t, "slcan/board-01", topic)
+	assert.Equal(t, PortMessage{Type: PortRelease, Device: "board-01", Owner: DefaultPortOwner}, m)
+}
@@ -0,0 +1,50 @@
+package mcumgrsvc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestReconnect checks reconnect backs off twice as long after every failed
+// connection, up to the maximum, and starts over once one got through.
+func TestReconnect(t *testing.T) {
+	defer func(d, max time.Duration) { handoverBackoff, maxHandoverBackoff = d, max }(handoverBackoff, maxHandoverBackoff)
+	handoverBackoff, maxHandoverBackoff = 10*time.Millisecond, 80*time.Millisecond
+	errDial := errors.New("connection refused")
+	errLost := errors.New("connection lost")
+
+	// The broker is down for five attempts, then the connection is lost
+	// once subscribed, and the next attempt is the last.
+	health := newHandoverHealth()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var calls []time.Time
+	dial := func(ctx context.Context) (bool, error) {
+		calls = append(calls, time.Now())
+		switch n := len(calls); {
+		case n <= 5:
+			return false, errDial
+		case n == 6:
+			health.set(true, nil)
+			return true, errLost
+		}
+		cancel()
+		return false, errDial
+	}
+	assert.Nil(t, reconnect(ctx, health, dial))
+	assert.Len(t, calls, 7)
+
+	for i, want := range []time.Duration{10, 20, 40, 80, 80} {
+		assert.GreaterOrEqual(t, calls[i+1].Sub(calls[i]), want*time.Millisecond, "attempt %d", i+2)
+	}
+	assert.Less(t, calls[6].Sub(calls[5]), 80*time.Millisecond)
+
+	h := health.get()
+	assert.False(t, h.Connected)
+	assert.Equal(t, 1, h.Reconnects)
+	assert.Equal(t, errLost, h.Err)
+}
@@ -0,0 +1,41 @@
+package mcumgrsvc
+
+import "sync"
+
+// hub hands events to its subscribers. Events are dropped for subscribers that
+// don't keep up, so a slow one never stalls the publisher.
+type hub[T any] struct {
+	mtx  sync.Mutex
+	subs map[chan T]struct{}
+}
+
+func (h *hub[T]) subscribe() (<-chan T, func()) {
+	c := make(chan T, 16)
+	h.mtx.Lock()
+	if h.subs == nil {
+		h.subs = make(map[chan T]struct{})
+	}
+	h.subs[c] = struct{}{}
+	h.mtx.Unlock()
+
+	var once sync.Once
+	return c, func() {
+		once.Do(func() {
+			h.mtx.Lock()
+			delete(h.subs, c)
+			h.mtx.Unlock()
+			close(c)
+		})
+	}
+}
+
+func (h *hub[T]) publish(v T) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for c := range h.subs {
+		select {
+		case c <- v:
+		default:
+		}
+	}
+}
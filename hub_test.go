@@ -0,0 +1,35 @@
+package mcumgrsvc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHub(t *testing.T) {
+	var h hub[Progress]
+	c1, unsubscribe1 := h.subscribe()
+	c2, unsubscribe2 := h.subscribe()
+
+	m := newProgressMeter(1000, 0)
+	h.publish(m.event(0))
+	h.publish(m.event(250))
+	assert.Equal(t, int64(0), (<-c1).Sent)
+	p := <-c1
+	assert.Equal(t, int64(250), p.Sent)
+	assert.Equal(t, int64(1000), p.Total)
+	assert.True(t, p.Rate > 0)
+	assert.True(t, p.ETA > 0)
+
+	unsubscribe1()
+	unsubscribe1()
+	_, ok := <-c1
+	assert.False(t, ok)
+
+	// Events for a subscriber that doesn't keep up are dropped.
+	for i := 0; i < 100; i++ {
+		h.publish(m.event(uint32(i)))
+	}
+	assert.Equal(t, cap(c2), len(c2))
+	unsubscribe2()
+}
@@ -0,0 +1,244 @@
+package mcumgrsvc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"mynewt.apache.org/newtmgr/nmxact/sesn"
+	"mynewt.apache.org/newtmgr/nmxact/xact"
+)
+
+// ImageSlot describes an image slot as reported by the device.
+type ImageSlot struct {
+	Image     int    `json:"image"`
+	Slot      int    `json:"slot"`
+	Version   string `json:"version"`
+	Hash      []byte `json:"hash"`
+	Bootable  bool   `json:"bootable"`
+	Pending   bool   `json:"pending"`
+	Confirmed bool   `json:"confirmed"`
+	Active    bool   `json:"active"`
+	Permanent bool   `json:"permanent"`
+}
+
+// FindImageSlot returns the entry of slots for the given image number and
+// slot.
+func FindImageSlot(slots []ImageSlot, image, slot int) (ImageSlot, bool) {
+	for _, s := range slots {
+		if s.Image == image && s.Slot == slot {
+			return s, true
+		}
+	}
+	return ImageSlot{}, false
+}
+
+// ListImages reads the state of the image slots of the device.
+func (b *mcumgrBackend) ListImages(ctx context.Context) ([]ImageSlot, error) {
+	var slots []ImageSlot
+	err := b.exec(ctx, func(ctx context.Context, d *Device) error {
+		var err error
+		slots, err = d.imageStateReadCmd()
+		return err
+	})
+	return slots, err
+}
+
+// TestImage marks the image with the given hash as pending, so the bootloader
+// swaps to it on the next reset and reverts unless it gets confirmed.
+func (b *mcumgrBackend) TestImage(ctx context.Context, hash []byte) error {
+	if len(hash) == 0 {
+		return ErrBackendImage
+	}
+	return b.exec(ctx, func(ctx context.Context, d *Device) error {
+		return d.imageStateWriteCmd(hash, false)
+	})
+}
+
+// ConfirmImage makes the image with the given hash permanent. An empty hash
+// confirms the image the device is running.
+func (b *mcumgrBackend) ConfirmImage(ctx context.Context, hash []byte) error {
+	return b.exec(ctx, func(ctx context.Context, d *Device) error {
+		return d.imageStateWriteCmd(hash, true)
+	})
+}
+
+// EraseImage erases the secondary image slot of the device.
+func (b *mcumgrBackend) EraseImage(ctx context.Context) error {
+	return b.exec(ctx, func(ctx context.Context, d *Device) error {
+		return d.imageEraseCmd()
+	})
+}
+
+// How long VerifyImage waits for a device to come back up after a reset.
+const (
+	verifyTries    = 6
+	verifyInterval = 5 * time.Second
+)
+
+// VerifyImage reconnects to the device after a reset and checks that image
+// imageNum runs from the image with the given hash. It returns the active slot
+// the device reported, so a device that reverted or booted something else can
+// be told apart.
+func (b *mcumgrBackend) VerifyImage(ctx context.Context, imageNum int, hash []byte) (ImageSlot, error) {
+	return verifyImage(ctx, func() ([]ImageSlot, error) {
+		var slots []ImageSlot
+		err := b.exec(ctx, func(ctx context.Context, d *Device) error {
+			var err error
+			slots, err = d.readImageState()
+			return err
+		})
+		return slots, err
+	}, imageNum, hash)
+}
+
+// verifyImage checks image imageNum runs from the image with the given hash,
+// reading the image state with read until the device answers or ctx is done.
+func verifyImage(ctx context.Context, read func() ([]ImageSlot, error), imageNum int, hash []byte) (ImageSlot, error) {
+	var slots []ImageSlot
+	var err error
+	for i := 0; i < verifyTries; i++ {
+		if i > 0 {
+			if err := sleep(ctx, verifyInterval); err != nil {
+				return ImageSlot{}, err
+			}
+		}
+		slots, err = read()
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return ImageSlot{}, err
+	}
+
+	for _, s := range slots {
+		if s.Image == imageNum && s.Active {
+			if !bytes.Equal(s.Hash, hash) {
+				return s, ErrBackendVerify
+			}
+			return s, nil
+		}
+	}
+	return ImageSlot{}, ErrBackendVerify
+}
+
+// verifyError describes why verifyImage failed to find the image of version
+// ver running: the device couldn't be reached, and err is returned as is, or
+// it runs another image, or none.
+func verifyError(err error, ver string, active ImageSlot) error {
+	switch {
+	case !errors.Is(err, ErrBackendVerify):
+		return err
+	case active.Hash == nil:
+		return fmt.Errorf("%w: expected %s, none running", err, ver)
+	}
+	return fmt.Errorf("%w: expected %s, running %s", err, ver, active.Version)
+}
+
+// readImageState reads the image state of a device which may have just
+// rebooted.
+func (d *Device) readImageState() ([]ImageSlot, error) {
+	slots, err := d.imageStateReadCmd()
+	if err != nil {
+		// The port may have gone away while the device rebooted, so
+		// start over with a fresh transport.
+		d.Close()
+	}
+	return slots, err
+}
+
+func (d *Device) imageStateReadCmd() ([]ImageSlot, error) {
+	s, err := d.session()
+	if err != nil {
+		return nil, ErrBackendState
+	}
+
+	c := xact.NewImageStateReadCmd()
+	var opt = sesn.TxOptions{
+		Timeout: time.Duration(5 * float64(time.Second)),
+		Tries:   2,
+	}
+	c.SetTxOptions(opt)
+
+	res, err := c.Run(s)
+	if err != nil {
+		return nil, err
+	}
+
+	ires := res.(*xact.ImageStateReadResult)
+	if ires.Status() != 0 {
+		return nil, ErrBackendState
+	}
+
+	slots := make([]ImageSlot, 0, len(ires.Rsp.Images))
+	for _, img := range ires.Rsp.Images {
+		slots = append(slots, ImageSlot{
+			Image:     img.Image,
+			Slot:      img.Slot,
+			Version:   img.Version,
+			Hash:      img.Hash,
+			Bootable:  img.Bootable,
+			Pending:   img.Pending,
+			Confirmed: img.Confirmed,
+			Active:    img.Active,
+			Permanent: img.Permanent,
+		})
+	}
+
+	return slots, nil
+}
+
+func (d *Device) imageStateWriteCmd(hash []byte, confirm bool) error {
+	s, err := d.session()
+	if err != nil {
+		return ErrBackendState
+	}
+
+	c := xact.NewImageStateWriteCmd()
+	var opt = sesn.TxOptions{
+		Timeout: time.Duration(5 * float64(time.Second)),
+		Tries:   2,
+	}
+	c.SetTxOptions(opt)
+	c.Hash = hash
+	c.Confirm = confirm
+
+	res, err := c.Run(s)
+	if err != nil {
+		return err
+	}
+
+	if res.Status() != 0 {
+		return ErrBackendState
+	}
+
+	return nil
+}
+
+func (d *Device) imageEraseCmd() error {
+	s, err := d.session()
+	if err != nil {
+		return ErrBackendErase
+	}
+
+	c := xact.NewImageEraseCmd()
+	var opt = sesn.TxOptions{
+		Timeout: time.Duration(5 * float64(time.Second)),
+		Tries:   2,
+	}
+	c.SetTxOptions(opt)
+
+	res, err := c.Run(s)
+	if err != nil {
+		return err
+	}
+
+	if res.Status() != 0 {
+		return ErrBackendErase
+	}
+
+	return nil
+}
@@ -0,0 +1,181 @@
+package mcumgrsvc
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jonathanyhliang/mcumgr-svc/mcuboot"
+	"github.com/stretchr/testify/assert"
+)
+
+// runBackend runs a backend for the device answering SMP at addr, owning its
+// port from the start.
+func runBackend(t *testing.T, e DeviceEntry) (*mcumgrBackend, *LocalHandover) {
+	h := NewLocalHandover(true)
+	b := NewMCUMgrBackendHandover(e, h).(*mcumgrBackend)
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := make(chan error)
+	go func() {
+		ran <- b.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-ran
+	})
+	assert.Eventually(t, func() bool {
+		return b.port.State() == PortOwned
+	}, time.Second, time.Millisecond)
+	return b, h
+}
+
+func TestImageManagement(t *testing.T) {
+	ctx := context.Background()
+	running := bytes.Repeat([]byte{1}, 32)
+	staged := bytes.Repeat([]byte{2}, 32)
+	d := newSMPDevice("1.0.0", running)
+	d.slots = append(d.slots, ImageSlot{Slot: 1, Version: "1.1.0", Hash: staged, Bootable: true})
+	b, _ := runBackend(t, DeviceEntry{Bid: "board-01", Type: ConnTypeUdp, Addr: d.serve(t)})
+
+	slots, err := b.ListImages(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []ImageSlot{
+		{Version: "1.0.0", Hash: running, Bootable: true, Confirmed: true, Active: true},
+		{Slot: 1, Version: "1.1.0", Hash: staged, Bootable: true},
+	}, slots)
+
+	assert.Equal(t, ErrBackendImage, b.TestImage(ctx, nil))
+	assert.Equal(t, ErrBackendState, b.TestImage(ctx, bytes.Repeat([]byte{3}, 32)))
+	assert.Nil(t, b.TestImage(ctx, staged))
+	slots, err = b.ListImages(ctx)
+	assert.Nil(t, err)
+	s, ok := FindImageSlot(slots, 0, 1)
+	assert.True(t, ok)
+	assert.True(t, s.Pending)
+	assert.False(t, s.Permanent)
+
+	assert.Nil(t, b.ConfirmImage(ctx, staged))
+	slots, err = b.ListImages(ctx)
+	assert.Nil(t, err)
+	s, _ = FindImageSlot(slots, 0, 1)
+	assert.True(t, s.Permanent)
+
+	assert.Nil(t, b.EraseImage(ctx))
+	slots, err = b.ListImages(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, slots, 1)
+	_, ok = FindImageSlot(slots, 0, 1)
+	assert.False(t, ok)
+}
+
+// TestBackendSwap checks a swap update is tested, booted and confirmed before
+// the port is released.
+func TestBackendSwap(t *testing.T) {
+	img := testImage()
+	parsed, err := mcuboot.Parse(img)
+	assert.Nil(t, err)
+	d := newSMPDevice("1.0.0", bytes.Repeat([]byte{1}, 32))
+	b, h := runBackend(t, DeviceEntry{Bid: "board-01", Type: ConnTypeUdp, Addr: d.serve(t), Swap: true,
+		Handover: HandoverConfig{Type: HandoverLocal, Peer: "slcan"}})
+	pub, stop := h.Published()
+	defer stop()
+
+	assert.Nil(t, b.UploadImage(context.Background(), bytes.NewReader(img), int64(len(img)), UploadOptions{}))
+	select {
+	case m := <-pub:
+		assert.Equal(t, PortRelease, m.Type)
+	case <-time.After(30 * time.Second):
+		t.Fatal("port not released")
+	}
+	assert.Equal(t, StateDone, b.State().Status().State)
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	assert.Equal(t, 1, d.resets)
+	assert.Equal(t, parsed.Hash, d.slots[0].Hash)
+	assert.True(t, d.slots[0].Active)
+	assert.True(t, d.slots[0].Confirmed)
+}
+
+// TestBackendDetectSwap checks a device staging the image in slot 1 is
+// updated in swap mode, or MCUboot would never boot the image, and one taking
+// it in slot 0 isn't.
+func TestBackendDetectSwap(t *testing.T) {
+	img := testImage()
+	parsed, err := mcuboot.Parse(img)
+	assert.Nil(t, err)
+	for _, recovery := range []bool{false, true} {
+		d := newSMPDevice("1.0.0", bytes.Repeat([]byte{1}, 32))
+		d.recovery = recovery
+		b, _ := runBackend(t, DeviceEntry{Bid: "board-01", Type: ConnTypeUdp, Addr: d.serve(t)})
+		var states []State
+		changes, stop := b.State().Watch()
+
+		assert.Nil(t, b.UploadImage(context.Background(), bytes.NewReader(img), int64(len(img)), UploadOptions{}))
+		for st := range changes {
+			states = append(states, st.State)
+			if st.State.Terminal() {
+				break
+			}
+		}
+		stop()
+		assert.Equal(t, StateDone, b.State().Status().State)
+		if recovery {
+			assert.NotContains(t, states, StateConfirming)
+		} else {
+			assert.Contains(t, states, StateConfirming)
+		}
+
+		d.mtx.Lock()
+		assert.Equal(t, 1, d.resets)
+		assert.Equal(t, parsed.Hash, d.slots[0].Hash)
+		assert.True(t, d.slots[0].Active)
+		assert.True(t, d.slots[0].Confirmed)
+		d.mtx.Unlock()
+	}
+}
+
+func TestVerifyImage(t *testing.T) {
+	ctx := context.Background()
+	old := ImageSlot{Version: "1.0.0", Hash: []byte{1}, Active: true}
+	read := func() ([]ImageSlot, error) {
+		return []ImageSlot{old, {Slot: 1, Version: "1.1.0", Hash: []byte{2}}}, nil
+	}
+	s, err := verifyImage(ctx, read, 0, []byte{2})
+	assert.Equal(t, ErrBackendVerify, err)
+	assert.Equal(t, old, s)
+	s, err = verifyImage(ctx, read, 0, []byte{1})
+	assert.Nil(t, err)
+	assert.Equal(t, old, s)
+	_, err = verifyImage(ctx, read, 1, []byte{1})
+	assert.Equal(t, ErrBackendVerify, err)
+}
+
+func TestVerifyError(t *testing.T) {
+	assert.Equal(t, ErrBackendState, verifyError(ErrBackendState, "1.1.0", ImageSlot{}))
+	err := verifyError(ErrBackendVerify, "1.1.0", ImageSlot{Version: "1.0.0", Hash: []byte{1}, Active: true})
+	assert.ErrorIs(t, err, ErrBackendVerify)
+	assert.Contains(t, err.Error(), "expected 1.1.0, running 1.0.0")
+	err = verifyError(ErrBackendVerify, "1.1.0", ImageSlot{})
+	assert.ErrorIs(t, err, ErrBackendVerify)
+	assert.Contains(t, err.Error(), "expected 1.1.0, none running")
+}
+
+// TestVerifyImageRevert checks VerifyImage reports the image a device reverted
+// to after failing to boot the image under test.
+func TestVerifyImageRevert(t *testing.T) {
+	ctx := context.Background()
+	running := bytes.Repeat([]byte{1}, 32)
+	staged := bytes.Repeat([]byte{2}, 32)
+	d := newSMPDevice("1.0.0", running)
+	d.slots = append(d.slots, ImageSlot{Slot: 1, Version: "1.1.0", Hash: staged, Bootable: true})
+	d.revert = true
+	b, _ := runBackend(t, DeviceEntry{Bid: "board-01", Type: ConnTypeUdp, Addr: d.serve(t)})
+
+	assert.Nil(t, b.TestImage(ctx, staged))
+	assert.Nil(t, b.Reset(ctx))
+	s, err := b.VerifyImage(ctx, 0, staged)
+	assert.Equal(t, ErrBackendVerify, err)
+	assert.Equal(t, ImageSlot{Version: "1.0.0", Hash: running, Bootable: true, Confirmed: true, Active: true}, s)
+}
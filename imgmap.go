@@ -0,0 +1,16 @@
+package mcumgrsvc
+
+import "io"
+
+// readImage reads the whole image of the given size from r into memory. It
+// fails with io.ErrUnexpectedEOF if r holds less, e.g. a truncated file.
+func readImage(r io.ReaderAt, size int64) ([]byte, func(), error) {
+	f := make([]byte, size)
+	if n, err := r.ReadAt(f, 0); n < len(f) {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, nil, err
+	}
+	return f, func() {}, nil
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package mcumgrsvc
+
+import "io"
+
+// mapImage returns the image of the given size read from r, and a function
+// releasing it once uploaded. Without mmap, the image is read into memory as a
+// whole.
+func mapImage(r io.ReaderAt, size int64) ([]byte, func(), error) {
+	return readImage(r, size)
+}
@@ -0,0 +1,45 @@
+package mcumgrsvc
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMapImage(t *testing.T) {
+	img := testImage()
+	name := filepath.Join(t.TempDir(), "image.bin")
+	assert.Nil(t, os.WriteFile(name, img, 0o644))
+	f, err := os.Open(name)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	for _, r := range []io.ReaderAt{f, bytes.NewReader(img)} {
+		b, free, err := mapImage(r, int64(len(img)))
+		assert.Nil(t, err)
+		assert.Equal(t, img, b)
+		free()
+	}
+}
+
+// TestMapImageTruncated checks an image shorter than its size, e.g. a
+// truncated cache file, is refused rather than padded.
+func TestMapImageTruncated(t *testing.T) {
+	img := testImage()
+	name := filepath.Join(t.TempDir(), "image.bin")
+	assert.Nil(t, os.WriteFile(name, img[:len(img)-16], 0o644))
+	f, err := os.Open(name)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	for _, r := range []io.ReaderAt{f, bytes.NewReader(img[:len(img)-16])} {
+		_, _, err := mapImage(r, int64(len(img)))
+		assert.Equal(t, io.ErrUnexpectedEOF, err)
+		_, _, err = readImage(r, int64(len(img)))
+		assert.Equal(t, io.ErrUnexpectedEOF, err)
+	}
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package mcumgrsvc
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// mapImage returns the image of the given size read from r, and a function
+// releasing it once uploaded. An *os.File is mapped read-only, so the image is
+// paged in from disk as the upload goes instead of taking up heap; any other
+// reader, or a file that can't be mapped, is read into memory as a whole. It
+// fails with io.ErrUnexpectedEOF if r holds less than size bytes.
+func mapImage(r io.ReaderAt, size int64) ([]byte, func(), error) {
+	if f, ok := r.(*os.File); ok && size > 0 {
+		// Pages past the end of the file can't be read.
+		if fi, err := f.Stat(); err == nil && fi.Size() < size {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		b, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+		if err == nil {
+			return b, func() { syscall.Munmap(b) }, nil
+		}
+	}
+	return readImage(r, size)
+}
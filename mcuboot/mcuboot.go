@@ -0,0 +1,308 @@
+// Package mcuboot parses MCUboot images, so firmware can be checked before it
+// is uploaded to a device.
+//
+// An image is a 32 byte header, followed by the image body, an optional
+// protected TLV area covered by the image hash and signatures, and the
+// unprotected TLV area carrying them.
+package mcuboot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrImageTooShort   = errors.New("Image: too short for an MCUboot image")
+	ErrImageMagic      = errors.New("Image: bad header magic")
+	ErrImageHeader     = errors.New("Image: invalid header")
+	ErrImageTLV        = errors.New("Image: invalid TLV area")
+	ErrImageNoHash     = errors.New("Image: missing SHA256 TLV")
+	ErrImageHash       = errors.New("Image: SHA256 mismatch")
+	ErrImageDependency = errors.New("Image: invalid dependency TLV")
+)
+
+const (
+	ImageMagic = 0x96f3b83d
+
+	HeaderSize = 32
+
+	tlvInfoMagic     = 0x6907
+	tlvProtInfoMagic = 0x6908
+	tlvInfoSize      = 4
+	tlvHeaderSize    = 4
+)
+
+// Image header flags.
+const (
+	FlagPIC              = 0x00000001
+	FlagEncryptedAES128  = 0x00000004
+	FlagEncryptedAES256  = 0x00000008
+	FlagNonBootable      = 0x00000010
+	FlagRAMLoad          = 0x00000020
+	FlagROMFixed         = 0x00000100
+	flagEncryptedAnyMask = FlagEncryptedAES128 | FlagEncryptedAES256
+)
+
+// TLV types.
+const (
+	TLVKeyHash    = 0x01
+	TLVPubKey     = 0x02
+	TLVSHA256     = 0x10
+	TLVSHA384     = 0x11
+	TLVSHA512     = 0x12
+	TLVRSA2048PSS = 0x20
+	TLVECDSA224   = 0x21
+	TLVECDSASig   = 0x22
+	TLVRSA3072PSS = 0x23
+	TLVED25519    = 0x24
+	TLVEncRSA2048 = 0x30
+	TLVEncKW      = 0x31
+	TLVEncEC256   = 0x32
+	TLVEncX25519  = 0x33
+	TLVDependency = 0x40
+	TLVSecCnt     = 0x50
+	TLVBootRecord = 0x60
+)
+
+var sigTypeNames = map[uint16]string{
+	TLVRSA2048PSS: "RSA2048_PSS",
+	TLVECDSA224:   "ECDSA224",
+	TLVECDSASig:   "ECDSA_P256",
+	TLVRSA3072PSS: "RSA3072_PSS",
+	TLVED25519:    "ED25519",
+}
+
+// Version is the semantic version of an image.
+type Version struct {
+	Major    uint8  `json:"major"`
+	Minor    uint8  `json:"minor"`
+	Revision uint16 `json:"revision"`
+	BuildNum uint32 `json:"buildNum"`
+}
+
+// String formats the version the way mcumgr reports it, e.g. "1.2.3" or
+// "1.2.3.4" when there is a build number.
+func (v Version) String() string {
+	if v.BuildNum == 0 {
+		return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Revision)
+	}
+	return fmt.Sprintf("%d.%d.%d.%d", v.Major, v.Minor, v.Revision, v.BuildNum)
+}
+
+// Header is the MCUboot image header.
+type Header struct {
+	Magic       uint32  `json:"magic"`
+	LoadAddr    uint32  `json:"loadAddr"`
+	HdrSize     uint16  `json:"hdrSize"`
+	ProtTLVSize uint16  `json:"protTlvSize"`
+	ImgSize     uint32  `json:"imgSize"`
+	Flags       uint32  `json:"flags"`
+	Version     Version `json:"version"`
+}
+
+// TLV is an entry of the TLV area of an image.
+type TLV struct {
+	Type      uint16 `json:"type"`
+	Data      []byte `json:"data"`
+	Protected bool   `json:"protected"`
+}
+
+// Dependency is the minimum version of another image an image requires.
+type Dependency struct {
+	ImageID    uint8   `json:"imageId"`
+	MinVersion Version `json:"minVersion"`
+}
+
+// Image is a parsed MCUboot image.
+type Image struct {
+	Header       Header       `json:"header"`
+	TLVs         []TLV        `json:"tlvs"`
+	Hash         []byte       `json:"hash"`
+	Dependencies []Dependency `json:"dependencies,omitempty"`
+	// Digest is the SHA256 of the header, body and protected TLV area of the
+	// image. It matches Hash unless the image is encrypted, in which case
+	// Hash is that of the plaintext.
+	Digest []byte `json:"-"`
+}
+
+// Parse parses and checks an MCUboot image held in memory. See ParseReader.
+func Parse(b []byte) (*Image, error) {
+	return ParseReader(bytes.NewReader(b), int64(len(b)))
+}
+
+// ParseReader parses and checks the MCUboot image of the given size read from
+// r. It fails unless the header is sound, the TLV areas are well formed and the
+// SHA256 TLV matches the image. The SHA256 TLV of an encrypted image is that of
+// the plaintext, which MCUboot checks once it decrypted the image, so it isn't
+// checked here. Only the header and TLV areas are held in
+// memory, so large images can be checked straight from disk. Anything following
+// the TLV area, such as the padding and trailer of an image padded to the slot
+// size, is ignored.
+func ParseReader(r io.ReaderAt, size int64) (*Image, error) {
+	if size < HeaderSize {
+		return nil, ErrImageTooShort
+	}
+	b := make([]byte, HeaderSize)
+	if _, err := r.ReadAt(b, 0); err != nil {
+		return nil, err
+	}
+
+	var img Image
+	h := &img.Header
+	h.Magic = binary.LittleEndian.Uint32(b[0:4])
+	h.LoadAddr = binary.LittleEndian.Uint32(b[4:8])
+	h.HdrSize = binary.LittleEndian.Uint16(b[8:10])
+	h.ProtTLVSize = binary.LittleEndian.Uint16(b[10:12])
+	h.ImgSize = binary.LittleEndian.Uint32(b[12:16])
+	h.Flags = binary.LittleEndian.Uint32(b[16:20])
+	h.Version.Major = b[20]
+	h.Version.Minor = b[21]
+	h.Version.Revision = binary.LittleEndian.Uint16(b[22:24])
+	h.Version.BuildNum = binary.LittleEndian.Uint32(b[24:28])
+
+	if h.Magic != ImageMagic {
+		return nil, ErrImageMagic
+	}
+	if h.HdrSize < HeaderSize {
+		return nil, ErrImageHeader
+	}
+
+	off := int64(h.HdrSize) + int64(h.ImgSize)
+	if off > size {
+		return nil, ErrImageHeader
+	}
+
+	if h.ProtTLVSize != 0 {
+		tlvs, n, err := parseTLVArea(r, size, off, tlvProtInfoMagic, true)
+		if err != nil {
+			return nil, err
+		}
+		if int64(h.ProtTLVSize) != n {
+			return nil, ErrImageTLV
+		}
+		img.TLVs = append(img.TLVs, tlvs...)
+		off += n
+	}
+
+	sum := sha256.New()
+	if _, err := io.Copy(sum, io.NewSectionReader(r, 0, off)); err != nil {
+		return nil, err
+	}
+	img.Digest = sum.Sum(nil)
+
+	tlvs, _, err := parseTLVArea(r, size, off, tlvInfoMagic, false)
+	if err != nil {
+		return nil, err
+	}
+	img.TLVs = append(img.TLVs, tlvs...)
+
+	for _, t := range img.TLVs {
+		switch t.Type {
+		case TLVSHA256:
+			img.Hash = t.Data
+		case TLVDependency:
+			d, err := parseDependency(t.Data)
+			if err != nil {
+				return nil, err
+			}
+			img.Dependencies = append(img.Dependencies, d)
+		}
+	}
+
+	if img.Hash == nil {
+		return nil, ErrImageNoHash
+	}
+	if !img.Encrypted() && !bytes.Equal(img.Digest, img.Hash) {
+		return nil, ErrImageHash
+	}
+
+	return &img, nil
+}
+
+// Encrypted reports whether the image body is encrypted.
+func (img *Image) Encrypted() bool {
+	return img.Header.Flags&flagEncryptedAnyMask != 0
+}
+
+// Find returns the data of every TLV of the given type.
+func (img *Image) Find(typ uint16) [][]byte {
+	var data [][]byte
+	for _, t := range img.TLVs {
+		if t.Type == typ {
+			data = append(data, t.Data)
+		}
+	}
+	return data
+}
+
+// SignatureTypes returns the names of the signature TLVs of the image, e.g.
+// "ECDSA_P256" or "ED25519".
+func (img *Image) SignatureTypes() []string {
+	var names []string
+	for _, t := range img.TLVs {
+		if n, ok := sigTypeNames[t.Type]; ok {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// parseTLVArea parses the TLV area at off, returning its TLVs and its size,
+// including the info header.
+func parseTLVArea(r io.ReaderAt, size, off int64, magic uint16, protected bool) ([]TLV, int64, error) {
+	if off+tlvInfoSize > size {
+		return nil, 0, ErrImageTLV
+	}
+	info := make([]byte, tlvInfoSize)
+	if _, err := r.ReadAt(info, off); err != nil {
+		return nil, 0, err
+	}
+	if binary.LittleEndian.Uint16(info[0:2]) != magic {
+		return nil, 0, ErrImageTLV
+	}
+	n := int64(binary.LittleEndian.Uint16(info[2:4]))
+	if n < tlvInfoSize || off+n > size {
+		return nil, 0, ErrImageTLV
+	}
+	b := make([]byte, n-tlvInfoSize)
+	if _, err := r.ReadAt(b, off+tlvInfoSize); err != nil {
+		return nil, 0, err
+	}
+
+	var tlvs []TLV
+	for p := 0; p < len(b); {
+		if p+tlvHeaderSize > len(b) {
+			return nil, 0, ErrImageTLV
+		}
+		typ := binary.LittleEndian.Uint16(b[p : p+2])
+		l := int(binary.LittleEndian.Uint16(b[p+2 : p+4]))
+		p += tlvHeaderSize
+		if p+l > len(b) {
+			return nil, 0, ErrImageTLV
+		}
+		tlvs = append(tlvs, TLV{Type: typ, Data: b[p : p+l], Protected: protected})
+		p += l
+	}
+
+	return tlvs, n, nil
+}
+
+func parseDependency(b []byte) (Dependency, error) {
+	// image_id, 3 bytes of padding and the minimum version
+	if len(b) != 12 {
+		return Dependency{}, ErrImageDependency
+	}
+	return Dependency{
+		ImageID: b[0],
+		MinVersion: Version{
+			Major:    b[4],
+			Minor:    b[5],
+			Revision: binary.LittleEndian.Uint16(b[6:8]),
+			BuildNum: binary.LittleEndian.Uint32(b[8:12]),
+		},
+	}, nil
+}
@@ -0,0 +1,130 @@
+package mcuboot
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testTLV struct {
+	typ  uint16
+	data []byte
+}
+
+func appendTLVArea(b []byte, magic uint16, tlvs []testTLV) []byte {
+	size := tlvInfoSize
+	for _, t := range tlvs {
+		size += tlvHeaderSize + len(t.data)
+	}
+	b = binary.LittleEndian.AppendUint16(b, magic)
+	b = binary.LittleEndian.AppendUint16(b, uint16(size))
+	for _, t := range tlvs {
+		b = binary.LittleEndian.AppendUint16(b, t.typ)
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(t.data)))
+		b = append(b, t.data...)
+	}
+	return b
+}
+
+// buildImage returns an MCUboot image of version 1.2.3+4 with the given body,
+// protected TLVs and unprotected TLVs, followed by a SHA256 TLV and, if sign
+// is set, the TLVs sign returns for the image digest.
+func buildImage(body []byte, prot []testTLV, tlvs []testTLV, sign ...func(digest []byte) []testTLV) []byte {
+	return buildImageFlags(0, body, prot, tlvs, sign...)
+}
+
+// buildImageFlags is buildImage with the given header flags.
+func buildImageFlags(flags uint32, body []byte, prot []testTLV, tlvs []testTLV, sign ...func(digest []byte) []testTLV) []byte {
+	var protSize int
+	if len(prot) > 0 {
+		protSize = len(appendTLVArea(nil, tlvProtInfoMagic, prot))
+	}
+
+	b := make([]byte, HeaderSize)
+	binary.LittleEndian.PutUint32(b[0:4], ImageMagic)
+	binary.LittleEndian.PutUint16(b[8:10], HeaderSize)
+	binary.LittleEndian.PutUint16(b[10:12], uint16(protSize))
+	binary.LittleEndian.PutUint32(b[12:16], uint32(len(body)))
+	binary.LittleEndian.PutUint32(b[16:20], flags)
+	b[20], b[21] = 1, 2
+	binary.LittleEndian.PutUint16(b[22:24], 3)
+	binary.LittleEndian.PutUint32(b[24:28], 4)
+	b = append(b, body...)
+	if len(prot) > 0 {
+		b = appendTLVArea(b, tlvProtInfoMagic, prot)
+	}
+
+	sum := sha256.Sum256(b)
+	tlvs = append(tlvs, testTLV{TLVSHA256, sum[:]})
+	for _, fn := range sign {
+		tlvs = append(tlvs, fn(sum[:])...)
+	}
+	return appendTLVArea(b, tlvInfoMagic, tlvs)
+}
+
+func TestParse(t *testing.T) {
+	dep := []byte{1, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0}
+	b := buildImage([]byte("firmware"), []testTLV{{TLVDependency, dep}},
+		[]testTLV{{TLVKeyHash, make([]byte, 32)}, {TLVECDSASig, make([]byte, 72)}})
+
+	img, err := Parse(b)
+	assert.Nil(t, err)
+	assert.Equal(t, "1.2.3.4", img.Header.Version.String())
+	assert.Equal(t, uint32(len("firmware")), img.Header.ImgSize)
+	assert.Equal(t, 32, len(img.Hash))
+	assert.Equal(t, []string{"ECDSA_P256"}, img.SignatureTypes())
+	assert.Equal(t, []Dependency{{ImageID: 1, MinVersion: Version{Major: 2}}}, img.Dependencies)
+	assert.True(t, img.TLVs[0].Protected)
+	assert.False(t, img.Encrypted())
+
+	// Padding up to the slot size is ignored.
+	_, err = Parse(append(b, 0xff, 0xff, 0xff, 0xff))
+	assert.Nil(t, err)
+}
+
+func TestParseInvalid(t *testing.T) {
+	b := buildImage([]byte("firmware"), nil, nil)
+
+	_, err := Parse([]byte("<html><body>Not Found</body></html>"))
+	assert.Equal(t, ErrImageMagic, err)
+	_, err = Parse(b[:16])
+	assert.Equal(t, ErrImageTooShort, err)
+	_, err = Parse(b[:HeaderSize+4])
+	assert.Equal(t, ErrImageHeader, err)
+	_, err = Parse(b[:len(b)-1])
+	assert.Equal(t, ErrImageTLV, err)
+
+	c := append([]byte{}, b...)
+	c[HeaderSize] ^= 0xff
+	_, err = Parse(c)
+	assert.Equal(t, ErrImageHash, err)
+
+	_, err = Parse(buildImage([]byte("firmware"), nil, []testTLV{{TLVDependency, []byte{1}}}))
+	assert.Equal(t, ErrImageDependency, err)
+}
+
+func TestParseEncrypted(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	sign := func(digest []byte) []testTLV {
+		return []testTLV{{TLVED25519, ed25519.Sign(key, digest)}}
+	}
+	body := []byte("firmware")
+	b := buildImageFlags(FlagEncryptedAES128, body, nil, []testTLV{{TLVEncKW, make([]byte, 24)}}, sign)
+	// imgtool hashes and signs the plaintext, then encrypts the body.
+	for i := range body {
+		b[HeaderSize+i] ^= 0x5a
+	}
+
+	img, err := Parse(b)
+	assert.Nil(t, err)
+	assert.True(t, img.Encrypted())
+	assert.NotEqual(t, img.Digest, img.Hash)
+	assert.Nil(t, img.VerifySignature([]crypto.PublicKey{pub}))
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	assert.Equal(t, ErrImageSignature, img.VerifySignature([]crypto.PublicKey{other}))
+}
@@ -0,0 +1,128 @@
+package mcuboot
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+)
+
+var (
+	ErrKeyFormat      = errors.New("Image: unsupported public key")
+	ErrImageUnsigned  = errors.New("Image: no signature TLV")
+	ErrImageSignature = errors.New("Image: signature not made by a trusted key")
+)
+
+// LoadPublicKey reads a PEM encoded public key, as written by
+// "imgtool getpub --encoding pem". ECDSA P-256, Ed25519 and RSA keys are
+// supported.
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	f, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePublicKey(f)
+}
+
+// LoadPublicKeys reads the PEM encoded public keys at paths.
+func LoadPublicKeys(paths []string) ([]crypto.PublicKey, error) {
+	keys := make([]crypto.PublicKey, 0, len(paths))
+	for _, p := range paths {
+		k, err := LoadPublicKey(p)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// ParsePublicKey parses a PEM encoded PKIX or PKCS #1 public key.
+func ParsePublicKey(b []byte) (crypto.PublicKey, error) {
+	blk, _ := pem.Decode(b)
+	if blk == nil {
+		return nil, ErrKeyFormat
+	}
+
+	var key crypto.PublicKey
+	var err error
+	switch blk.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(blk.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(blk.Bytes)
+	default:
+		return nil, ErrKeyFormat
+	}
+	if err != nil {
+		return nil, ErrKeyFormat
+	}
+
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, ErrKeyFormat
+		}
+	case ed25519.PublicKey, *rsa.PublicKey:
+	default:
+		return nil, ErrKeyFormat
+	}
+	return key, nil
+}
+
+// VerifySignature checks that the image carries a signature TLV made by one of
+// keys, the way MCUboot checks it at boot. Signatures are made over the SHA256
+// TLV, which for encrypted images is checked against the plaintext by MCUboot
+// only.
+func (img *Image) VerifySignature(keys []crypto.PublicKey) error {
+	signed := false
+	for _, t := range img.TLVs {
+		if _, ok := sigTypeNames[t.Type]; !ok || t.Protected {
+			continue
+		}
+		signed = true
+		for _, k := range keys {
+			if verifySignature(t.Type, t.Data, img.Hash, k) {
+				return nil
+			}
+		}
+	}
+
+	if !signed {
+		return ErrImageUnsigned
+	}
+	return ErrImageSignature
+}
+
+func verifySignature(typ uint16, sig, digest []byte, key crypto.PublicKey) bool {
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if typ != TLVECDSASig {
+			return false
+		}
+		// Older imgtool versions pad the DER signature with zeros to a
+		// fixed size.
+		if len(sig) > 2 && int(sig[1])+2 < len(sig) {
+			sig = sig[:int(sig[1])+2]
+		}
+		return ecdsa.VerifyASN1(k, digest, sig)
+	case ed25519.PublicKey:
+		if typ != TLVED25519 {
+			return false
+		}
+		return ed25519.Verify(k, digest, sig)
+	case *rsa.PublicKey:
+		if (typ != TLVRSA2048PSS || k.Size() != 256) && (typ != TLVRSA3072PSS || k.Size() != 384) {
+			return false
+		}
+		opts := &rsa.PSSOptions{SaltLength: sha256.Size, Hash: crypto.SHA256}
+		return rsa.VerifyPSS(k, crypto.SHA256, digest, sig, opts) == nil
+	}
+	return false
+}
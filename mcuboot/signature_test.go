@@ -0,0 +1,70 @@
+package mcuboot
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifySignature(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	signers := map[string]func(digest []byte) []testTLV{
+		"ecdsa": func(digest []byte) []testTLV {
+			sig, _ := ecdsa.SignASN1(rand.Reader, ecKey, digest)
+			// Padded the way older imgtool versions do.
+			sig = append(sig, make([]byte, 72-len(sig))...)
+			return []testTLV{{TLVECDSASig, sig}}
+		},
+		"ed25519": func(digest []byte) []testTLV {
+			return []testTLV{{TLVED25519, ed25519.Sign(edKey, digest)}}
+		},
+		"rsa": func(digest []byte) []testTLV {
+			opts := &rsa.PSSOptions{SaltLength: sha256.Size, Hash: crypto.SHA256}
+			sig, _ := rsa.SignPSS(rand.Reader, rsaKey, crypto.SHA256, digest, opts)
+			return []testTLV{{TLVRSA2048PSS, sig}}
+		},
+	}
+	keys := []crypto.PublicKey{&ecKey.PublicKey, edPub, &rsaKey.PublicKey}
+
+	for name, sign := range signers {
+		img, err := Parse(buildImage([]byte("firmware"), nil, nil, sign))
+		assert.Nil(t, err, name)
+		assert.Nil(t, img.VerifySignature(keys), name)
+		assert.Equal(t, ErrImageSignature, img.VerifySignature(nil), name)
+	}
+
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	img, _ := Parse(buildImage([]byte("firmware"), nil, nil, signers["ecdsa"]))
+	assert.Equal(t, ErrImageSignature, img.VerifySignature([]crypto.PublicKey{&other.PublicKey}))
+
+	img, _ = Parse(buildImage([]byte("firmware"), nil, nil))
+	assert.Equal(t, ErrImageUnsigned, img.VerifySignature(keys))
+}
+
+func TestParsePublicKey(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	k, err := ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	assert.Nil(t, err)
+	assert.True(t, ecKey.PublicKey.Equal(k))
+
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	der, _ = x509.MarshalPKIXPublicKey(&p384.PublicKey)
+	_, err = ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	assert.Equal(t, ErrKeyFormat, err)
+
+	_, err = ParsePublicKey([]byte("not a key"))
+	assert.Equal(t, ErrKeyFormat, err)
+}
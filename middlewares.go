@@ -2,6 +2,7 @@ package mcumgrsvc
 
 import (
 	"context"
+	"io"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -47,16 +48,38 @@ func (mw loggingMiddleware) GetDeployBase(ctx context.Context, bid, acid string)
 }
 
 func (mw loggingMiddleware) PostDeployBaseFeedback(ctx context.Context, bid string,
-	fb hawkbit.DeploymentBaseFeedback) (err error) {
+	fb DeploymentBaseFeedback) (err error) {
 	defer func(begin time.Time) {
 		mw.logger.Log("method", "PostDeployBaseFeedback", "bid", bid, "took", time.Since(begin), "err", err)
 	}(time.Now())
 	return mw.next.PostDeployBaseFeedback(ctx, bid, fb)
 }
 
-func (mw loggingMiddleware) GetDownloadHttp(ctx context.Context, bid, ver string) []byte {
+func (mw loggingMiddleware) GetDownloadHttpStream(ctx context.Context, bid, ver string, off int64) (r io.ReadCloser, start int64, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log("method", "GetDownloadHttp", "bid", bid, "ver", ver, "took", time.Since(begin))
+		mw.logger.Log("method", "GetDownloadHttpStream", "bid", bid, "ver", ver, "off", off, "start", start, "took", time.Since(begin), "err", err)
 	}(time.Now())
-	return mw.next.GetDownloadHttp(ctx, bid, ver)
+	return mw.next.GetDownloadHttpStream(ctx, bid, ver, off)
+}
+
+func (mw loggingMiddleware) GetInstalledBase(ctx context.Context, bid, acid string) (ib hawkbit.DeploymentBase, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "GetInstalledBase", "bid", bid, "acid", acid, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.GetInstalledBase(ctx, bid, acid)
+}
+
+func (mw loggingMiddleware) GetCancelAction(ctx context.Context, bid, acid string) (ca CancelAction, err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "GetCancelAction", "bid", bid, "acid", acid, "stopId", ca.CancelAction.StopID, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.GetCancelAction(ctx, bid, acid)
+}
+
+func (mw loggingMiddleware) PostCancelActionFeedback(ctx context.Context, bid string,
+	fb hawkbit.CancelActionFeedback) (err error) {
+	defer func(begin time.Time) {
+		mw.logger.Log("method", "PostCancelActionFeedback", "bid", bid, "acid", fb.ID, "execution", fb.Status.Execution, "took", time.Since(begin), "err", err)
+	}(time.Now())
+	return mw.next.PostCancelActionFeedback(ctx, bid, fb)
 }
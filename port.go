@@ -0,0 +1,172 @@
+package mcumgrsvc
+
+import (
+	"fmt"
+	"sync"
+)
+
+// PortState is who holds the serial port of a device.
+type PortState int
+
+const (
+	// PortReleased is the state of a port held by a peer, or not handed
+	// over yet.
+	PortReleased PortState = iota
+	// PortOwned is the state of an idle port handed over to the backend.
+	PortOwned
+	// PortBusy is the state of an owned port an update or reset is using.
+	PortBusy
+)
+
+var portStateNames = map[PortState]string{
+	PortReleased: "released",
+	PortOwned:    "owned",
+	PortBusy:     "busy",
+}
+
+func (s PortState) String() string {
+	if n, ok := portStateNames[s]; ok {
+		return n
+	}
+	return fmt.Sprintf("PortState(%d)", int(s))
+}
+
+// portOwner tracks who owns the serial port of a device, and the upload
+// waiting for the port while the backend doesn't own it. Acquiring and
+// releasing are idempotent, so duplicate handovers are harmless, and a port in
+// use is never released from under the update or reset using it.
+type portOwner struct {
+	mtx     sync.Mutex
+	state   PortState
+	pending *uploadJob
+	// queued is signalled whenever an upload is queued.
+	queued chan struct{}
+	// closed is set once the backend stopped running uploads.
+	closed bool
+}
+
+func newPortOwner() *portOwner {
+	return &portOwner{queued: make(chan struct{}, 1)}
+}
+
+// State returns the state of the port.
+func (p *portOwner) State() PortState {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.state
+}
+
+// acquire hands the port over to the backend, reporting whether it wasn't
+// already.
+func (p *portOwner) acquire() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.state != PortReleased {
+		return false
+	}
+	p.state = PortOwned
+	return true
+}
+
+// release hands the port back, reporting whether it was owned and idle. A port
+// in use stays with the backend.
+func (p *portOwner) release() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.state != PortOwned {
+		return false
+	}
+	p.state = PortReleased
+	return true
+}
+
+// use marks the port in use, reporting whether it was owned and idle.
+func (p *portOwner) use() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.state != PortOwned {
+		return false
+	}
+	p.state = PortBusy
+	return true
+}
+
+// done marks the port in use idle again.
+func (p *portOwner) done() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.state == PortBusy {
+		p.state = PortOwned
+	}
+}
+
+// available reports whether an upload could be scheduled.
+func (p *portOwner) available() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.state != PortBusy && p.pending == nil
+}
+
+// schedule queues j until the port is owned and idle. It fails with
+// ErrBackendBusy while the port is in use or another upload is queued, and
+// with ErrBackendClosed once the port is closed.
+func (p *portOwner) schedule(j uploadJob) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.closed {
+		return ErrBackendClosed
+	}
+	if p.state == PortBusy || p.pending != nil {
+		return ErrBackendBusy
+	}
+	p.pending = &j
+	select {
+	case p.queued <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// waiting returns the upload queued, if any.
+func (p *portOwner) waiting() (uploadJob, bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.pending == nil {
+		return uploadJob{}, false
+	}
+	return *p.pending, true
+}
+
+// next dequeues the upload queued and marks the port in use, provided it is
+// owned and idle.
+func (p *portOwner) next() (uploadJob, bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.pending == nil || p.state != PortOwned {
+		return uploadJob{}, false
+	}
+	j := *p.pending
+	p.pending = nil
+	p.state = PortBusy
+	return j, true
+}
+
+// drop dequeues the upload queued without running it.
+func (p *portOwner) drop() (uploadJob, bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.pending == nil {
+		return uploadJob{}, false
+	}
+	j := *p.pending
+	p.pending = nil
+	return j, true
+}
+
+// close makes schedule fail from now on. The upload queued, if any, is left
+// for drop.
+func (p *portOwner) close() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.closed = true
+}
@@ -0,0 +1,307 @@
+package mcumgrsvc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jonathanyhliang/mcumgr-svc/mcuboot"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPortOwner(t *testing.T) {
+	p := newPortOwner()
+	assert.Equal(t, PortReleased, p.State())
+	assert.False(t, p.use())
+	assert.False(t, p.release())
+
+	// Acquiring and releasing twice is harmless.
+	assert.True(t, p.acquire())
+	assert.False(t, p.acquire())
+	assert.Equal(t, PortOwned, p.State())
+	assert.True(t, p.release())
+	assert.False(t, p.release())
+	assert.Equal(t, PortReleased, p.State())
+
+	// An upload waits for the port, one at a time.
+	free := func() {}
+	assert.Nil(t, p.schedule(uploadJob{ver: "1.0.0", free: free}))
+	assert.Equal(t, ErrBackendBusy, p.schedule(uploadJob{ver: "1.0.1", free: free}))
+	assert.False(t, p.available())
+	<-p.queued
+	_, ok := p.next()
+	assert.False(t, ok)
+	p.acquire()
+	j, ok := p.next()
+	assert.True(t, ok)
+	assert.Equal(t, "1.0.0", j.ver)
+	assert.Equal(t, PortBusy, p.State())
+
+	// A port in use is neither released nor taken for another upload.
+	assert.False(t, p.release())
+	assert.False(t, p.acquire())
+	assert.False(t, p.use())
+	assert.Equal(t, ErrBackendBusy, p.schedule(uploadJob{free: free}))
+	p.done()
+	assert.Equal(t, PortOwned, p.State())
+	assert.True(t, p.available())
+
+	assert.Nil(t, p.schedule(uploadJob{ver: "1.0.2", free: free}))
+	j, ok = p.drop()
+	assert.True(t, ok)
+	assert.Equal(t, "1.0.2", j.ver)
+	_, ok = p.waiting()
+	assert.False(t, ok)
+
+	// Once closed, the upload queued is left to drop, and no other is.
+	assert.Nil(t, p.schedule(uploadJob{ver: "1.0.3", free: free}))
+	p.close()
+	assert.Equal(t, ErrBackendClosed, p.schedule(uploadJob{free: free}))
+	j, ok = p.drop()
+	assert.True(t, ok)
+	assert.Equal(t, "1.0.3", j.ver)
+	assert.Equal(t, ErrBackendClosed, p.schedule(uploadJob{free: free}))
+}
+
+// TestBackendCloseRace races uploads against Run returning, which must leave
+// none of them queued.
+func TestBackendCloseRace(t *testing.T) {
+	img := testImage()
+	for i := 0; i < 50; i++ {
+		// Without a grant, every upload scheduled waits in the queue.
+		b := NewMCUMgrBackendHandover(DeviceEntry{Bid: "board-01", Type: ConnTypeUdp, Addr: "127.0.0.1:1337"},
+			NewLocalHandover(false)).(*mcumgrBackend)
+		ctx, cancel := context.WithCancel(context.Background())
+		ran := make(chan error)
+		go func() {
+			ran <- b.Run(ctx)
+		}()
+		var wg sync.WaitGroup
+		for n := 0; n < 4; n++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				b.UploadImage(context.Background(), bytes.NewReader(img), int64(len(img)), UploadOptions{})
+			}()
+		}
+		cancel()
+		assert.Nil(t, <-ran)
+		wg.Wait()
+		_, ok := b.port.waiting()
+		assert.False(t, ok)
+	}
+}
+
+// TestPortOwnerConcurrent races grants and releases against uploads and
+// resets, which must never share the port.
+func TestPortOwnerConcurrent(t *testing.T) {
+	p := newPortOwner()
+	var users atomic.Int32
+	var wg sync.WaitGroup
+	use := func() {
+		if !p.use() {
+			return
+		}
+		assert.Equal(t, int32(1), users.Add(1))
+		assert.False(t, p.release())
+		users.Add(-1)
+		p.done()
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 1000; n++ {
+				p.acquire()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 1000; n++ {
+				p.release()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 1000; n++ {
+				use()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 1000; n++ {
+				if p.schedule(uploadJob{free: func() {}}) != nil {
+					continue
+				}
+				if j, ok := p.next(); ok {
+					assert.Equal(t, int32(1), users.Add(1))
+					users.Add(-1)
+					j.free()
+					p.done()
+				} else {
+					p.drop()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.NotEqual(t, PortBusy, p.State())
+
+	// Whatever the interleaving, the port is left usable.
+	p.acquire()
+	assert.True(t, p.use())
+}
+
+// testImage returns an unsigned MCUboot image.
+func testImage() []byte {
+	return testImageBody([]byte("firmware"))
+}
+
+// testImageBody returns an unsigned MCUboot image of the given body.
+func testImageBody(body []byte) []byte {
+	b := make([]byte, mcuboot.HeaderSize)
+	binary.LittleEndian.PutUint32(b[0:4], mcuboot.ImageMagic)
+	binary.LittleEndian.PutUint16(b[8:10], mcuboot.HeaderSize)
+	binary.LittleEndian.PutUint32(b[12:16], uint32(len(body)))
+	b = append(b, body...)
+	sum := sha256.Sum256(b)
+	b = binary.LittleEndian.AppendUint16(b, 0x6907)
+	b = binary.LittleEndian.AppendUint16(b, uint16(4+4+len(sum)))
+	b = binary.LittleEndian.AppendUint16(b, mcuboot.TLVSHA256)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(sum)))
+	return append(b, sum[:]...)
+}
+
+// TestBackendQueuesUpload checks an upload waits for the port to be handed
+// over, and is dropped once its context is done.
+func TestBackendQueuesUpload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := NewLocalHandover(false)
+	b := NewMCUMgrBackendHandover(DeviceEntry{Bid: "board-01", Type: ConnTypeUdp, Addr: "127.0.0.1:1337",
+		Handover: HandoverConfig{Type: HandoverLocal, Peer: "slcan"}}, h).(*mcumgrBackend)
+	pub, stop := h.Published()
+	defer stop()
+	ran := make(chan error)
+	go func() {
+		ran <- b.Run(ctx)
+	}()
+
+	img := testImage()
+	uctx, ucancel := context.WithCancel(ctx)
+	assert.Nil(t, b.UploadImage(uctx, bytes.NewReader(img), int64(len(img)), UploadOptions{}))
+	assert.Equal(t, StateScheduled, b.State().Status().State)
+	assert.Equal(t, PortMessage{Type: PortRequest, Device: "board-01", Owner: DefaultPortOwner}, <-pub)
+	assert.Equal(t, ErrBackendBusy, b.UploadImage(uctx, bytes.NewReader(img), int64(len(img)), UploadOptions{}))
+
+	// A denial leaves the upload waiting.
+	assert.Nil(t, h.Send(ctx, PortMessage{Type: PortDeny, Device: "board-01", Owner: DefaultPortOwner}))
+	assert.Equal(t, StateScheduled, b.State().Status().State)
+	assert.Equal(t, PortReleased, b.port.State())
+
+	ucancel()
+	assert.Eventually(t, func() bool {
+		return b.State().Status().State == StateFailed
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, context.Canceled, b.State().Status().Err)
+	_, ok := b.port.waiting()
+	assert.False(t, ok)
+
+	// Duplicate grants are harmless.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, h.Send(ctx, PortMessage{Type: PortGrant, Device: "board-01", Owner: DefaultPortOwner}))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, PortOwned, b.port.State())
+
+	cancel()
+	assert.Nil(t, <-ran)
+}
+
+// TestBackendRefusesReleasedPort checks resets and device commands are
+// refused while the port is with the peer.
+func TestBackendRefusesReleasedPort(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := NewLocalHandover(false)
+	b := NewMCUMgrBackendHandover(DeviceEntry{Bid: "board-01", Type: ConnTypeUdp, Addr: "127.0.0.1:1337",
+		Handover: HandoverConfig{Type: HandoverLocal, Peer: "slcan"}}, h).(*mcumgrBackend)
+	ran := make(chan error)
+	go func() {
+		ran <- b.Run(ctx)
+	}()
+
+	assert.Equal(t, ErrBackendBusy, b.Reset(ctx))
+	_, err := b.ListImages(ctx)
+	assert.Equal(t, ErrBackendBusy, err)
+	assert.Equal(t, ErrBackendBusy, b.EraseImage(ctx))
+	assert.Nil(t, b.LastError())
+	assert.Equal(t, PortReleased, b.port.State())
+
+	cancel()
+	assert.Nil(t, <-ran)
+}
+
+// TestBackendPortHandover hands the port over and back around an update and
+// resets, checking the port is only ever used while handed over.
+func TestBackendPortHandover(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	img := testImage()
+	parsed, err := mcuboot.Parse(img)
+	assert.Nil(t, err)
+	d := newSMPDevice("1.0.0", bytes.Repeat([]byte{1}, 32))
+	h := NewLocalHandover(false)
+	b := NewMCUMgrBackendHandover(DeviceEntry{Bid: "board-01", Type: ConnTypeUdp, Addr: d.serve(t), Swap: true,
+		Handover: HandoverConfig{Type: HandoverLocal, Peer: "slcan"}}, h).(*mcumgrBackend)
+	pub, stop := h.Published()
+	defer stop()
+	ran := make(chan error)
+	go func() {
+		ran <- b.Run(ctx)
+	}()
+	grant := PortMessage{Type: PortGrant, Device: "board-01", Owner: DefaultPortOwner}
+	request := PortMessage{Type: PortRequest, Device: "board-01", Owner: "slcan"}
+	release := PortMessage{Type: PortRelease, Device: "board-01", Owner: DefaultPortOwner}
+
+	assert.Equal(t, ErrBackendBusy, b.Reset(ctx))
+	assert.Nil(t, b.UploadImage(ctx, bytes.NewReader(img), int64(len(img)), UploadOptions{}))
+	assert.Equal(t, PortRequest, (<-pub).Type)
+	assert.Nil(t, h.Send(ctx, grant))
+
+	// The port goes back to the peer once the update is done, and is only
+	// reset once granted again.
+	select {
+	case m := <-pub:
+		assert.Equal(t, release, m)
+	case <-time.After(30 * time.Second):
+		t.Fatal("port not released")
+	}
+	assert.Equal(t, StateDone, b.State().Status().State)
+	assert.Equal(t, ErrBackendBusy, b.Reset(ctx))
+	assert.Nil(t, h.Send(ctx, request))
+	assert.Equal(t, PortMessage{Type: PortDeny, Device: "board-01", Owner: "slcan"}, <-pub)
+	assert.Nil(t, h.Send(ctx, grant))
+	assert.Nil(t, b.Reset(ctx))
+	assert.Equal(t, release, <-pub)
+	assert.Equal(t, PortReleased, b.port.State())
+	assert.Equal(t, ErrBackendBusy, b.Reset(ctx))
+
+	d.mtx.Lock()
+	assert.Equal(t, 2, d.resets)
+	assert.Equal(t, parsed.Hash, d.slots[0].Hash)
+	d.mtx.Unlock()
+
+	cancel()
+	assert.Nil(t, <-ran)
+}
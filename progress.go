@@ -0,0 +1,46 @@
+package mcumgrsvc
+
+import (
+	"fmt"
+	"time"
+)
+
+// Progress is an event reporting how far the upload of an image to the device
+// got.
+type Progress struct {
+	// Sent is the number of bytes the device acknowledged.
+	Sent int64 `json:"sent"`
+	// Total is the size of the image.
+	Total int64 `json:"total"`
+	// Rate is the upload rate in bytes per second.
+	Rate float64 `json:"rate"`
+	// ETA is the estimated time left until the upload completes.
+	ETA time.Duration `json:"eta"`
+}
+
+// String formats the event for humans, e.g. for Hawkbit action details.
+func (p Progress) String() string {
+	return fmt.Sprintf("uploaded %d of %d bytes (%.1f KiB/s, %s left)",
+		p.Sent, p.Total, p.Rate/1024, p.ETA.Round(time.Second))
+}
+
+// progressMeter turns the offsets acknowledged during an upload into progress
+// events.
+type progressMeter struct {
+	total int64
+	start time.Time
+	base  int64
+}
+
+func newProgressMeter(total int64, off uint32) *progressMeter {
+	return &progressMeter{total: total, start: time.Now(), base: int64(off)}
+}
+
+func (m *progressMeter) event(off uint32) Progress {
+	p := Progress{Sent: int64(off), Total: m.total}
+	if d := time.Since(m.start).Seconds(); d > 0 && p.Sent > m.base {
+		p.Rate = float64(p.Sent-m.base) / d
+		p.ETA = time.Duration(float64(p.Total-p.Sent) / p.Rate * float64(time.Second))
+	}
+	return p
+}
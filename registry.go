@@ -0,0 +1,222 @@
+package mcumgrsvc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+var (
+	ErrRegistryConfig    = errors.New("Registry: invalid config file")
+	ErrRegistryDevice    = errors.New("Registry: invalid device entry")
+	ErrRegistryDuplicate = errors.New("Registry: duplicate device entry")
+)
+
+// DefaultBaud is the baudrate used for a device entry that doesn't set one.
+const DefaultBaud = 115200
+
+// DefaultMtu is the serial MTU used for a device entry that doesn't set one.
+const DefaultMtu = 512
+
+// DefaultHandoverQueue is the queue, or MQTT topic, a backend waits on for the
+// serial port to be handed over, unless its handover config names its own. A
+// device entry naming none waits on DefaultHandoverQueue.<bid> instead, so the
+// boards of a gateway don't take each other's handovers.
+const DefaultHandoverQueue = "handover"
+
+// Connection types a device entry may use. The names follow newtmgr's
+// connection profile types.
+const (
+	ConnTypeSerial    = "serial"
+	ConnTypeOicSerial = "oic_serial"
+	ConnTypeUdp       = "udp"
+	ConnTypeOicUdp    = "oic_udp"
+)
+
+// DeviceEntry maps a Hawkbit controller ID to the MCU it manages, reached
+// either over a serial port or, for UDP connection types, at a "host:port"
+// address. OIC connection types may name CoAP filters registered with
+// RegisterCoapFilters. Upload holds the options images are uploaded to the MCU
+// with, and Swap marks MCUboot swap-based setups, where an uploaded image is
+// marked for test, booted and confirmed rather than just booted. MCUs staging
+// the upload in a secondary slot are updated that way without Swap, as MCUboot
+// only boots such an image once it is marked; MCUs updated in serial recovery
+// mode take it in the primary slot and are just booted. Verify checks the MCU
+// boots the uploaded image after reset, which swap mode always does; it is on
+// unless a gateway config sets it to false.
+// Keys lists PEM public key files; when set, only images signed by one of them
+// are uploaded. Handover says how and where the port is handed over; Queue is
+// short for its queue.
+type DeviceEntry struct {
+	Bid      string         `json:"bid"`
+	Type     string         `json:"type,omitempty"`
+	Port     string         `json:"port,omitempty"`
+	Baud     int            `json:"baud,omitempty"`
+	Mtu      int            `json:"mtu,omitempty"`
+	Addr     string         `json:"addr,omitempty"`
+	Filters  string         `json:"filters,omitempty"`
+	Queue    string         `json:"queue,omitempty"`
+	Handover HandoverConfig `json:"handover,omitempty"`
+	Upload   UploadOptions  `json:"upload,omitempty"`
+	Swap     bool           `json:"swap,omitempty"`
+	Verify   bool           `json:"verify"`
+	Keys     []string       `json:"keys,omitempty"`
+}
+
+// UnmarshalJSON decodes an entry of a gateway config, in which Verify defaults
+// to true, so success is only reported for an MCU seen running the image.
+func (e *DeviceEntry) UnmarshalJSON(b []byte) error {
+	type entry DeviceEntry
+	v := entry{Verify: true}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*e = DeviceEntry(v)
+	return nil
+}
+
+// handoverConfig returns the handover settings of the entry, with Queue
+// standing in for a queue Handover doesn't name.
+func (e DeviceEntry) handoverConfig() HandoverConfig {
+	cfg := e.Handover
+	if cfg.Queue == "" {
+		cfg.Queue = e.Queue
+	}
+	return cfg
+}
+
+// connProfileArgs returns the connection profile arguments of the entry, as
+// taken by NewDevice.
+func (e DeviceEntry) connProfileArgs() []string {
+	args := make([]string, 3)
+	args[0] = e.Bid
+	args[1] = "type=" + e.Type
+	switch e.Type {
+	case ConnTypeUdp, ConnTypeOicUdp:
+		args[2] = "connstring=" + e.Addr
+	default:
+		args[2] = fmt.Sprintf("connstring=dev=%s,baud=%d,mtu=%d", e.Port, e.Baud, e.Mtu)
+	}
+	return args
+}
+
+// Registry keeps the devices managed by one mcumgr-svc process.
+type Registry struct {
+	mtx     sync.RWMutex
+	entries map[string]DeviceEntry
+	order   []string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		entries: make(map[string]DeviceEntry),
+	}
+}
+
+// LoadRegistry reads a JSON config file of the form
+//
+//	{"devices": [{"bid": "board-01", "port": "/dev/ttyACM0", "baud": 115200}]}
+//
+// and returns a Registry holding its device entries.
+func LoadRegistry(path string) (*Registry, error) {
+	f, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg struct {
+		Devices []DeviceEntry `json:"devices"`
+	}
+	if err := json.Unmarshal(f, &cfg); err != nil {
+		return nil, ErrRegistryConfig
+	}
+	if len(cfg.Devices) == 0 {
+		return nil, ErrRegistryConfig
+	}
+
+	r := NewRegistry()
+	for _, e := range cfg.Devices {
+		if err := r.Add(e); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Add registers a device entry. Controller IDs, ports and addresses must be
+// unique across the registry.
+func (r *Registry) Add(e DeviceEntry) error {
+	if e.Type == "" {
+		e.Type = ConnTypeSerial
+	}
+	switch e.Type {
+	case ConnTypeSerial, ConnTypeOicSerial:
+		if e.Port == "" || e.Baud < 0 || e.Mtu < 0 {
+			return ErrRegistryDevice
+		}
+		if e.Baud == 0 {
+			e.Baud = DefaultBaud
+		}
+		if e.Mtu == 0 {
+			e.Mtu = DefaultMtu
+		}
+	case ConnTypeUdp, ConnTypeOicUdp:
+		if e.Addr == "" {
+			return ErrRegistryDevice
+		}
+	default:
+		return ErrRegistryDevice
+	}
+	if e.Bid == "" || e.Upload.ImageNum < 0 || e.Upload.MaxWinSz < 0 {
+		return ErrRegistryDevice
+	}
+	if e.Queue == "" {
+		e.Queue = DefaultHandoverQueue + "." + e.Bid
+	}
+	switch e.Handover.Type {
+	case "", HandoverAMQP, HandoverMQTT:
+	case HandoverLocal:
+		// Messages the backend publishes over a local handover only
+		// reach watchers within the process.
+		if e.Handover.Peer != "" {
+			return ErrRegistryDevice
+		}
+	default:
+		return ErrRegistryDevice
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, ok := r.entries[e.Bid]; ok {
+		return ErrRegistryDuplicate
+	}
+	for _, v := range r.entries {
+		if (e.Port != "" && v.Port == e.Port) || (e.Addr != "" && v.Addr == e.Addr) {
+			return ErrRegistryDuplicate
+		}
+	}
+	r.entries[e.Bid] = e
+	r.order = append(r.order, e.Bid)
+	return nil
+}
+
+// Get returns the device entry registered for the controller ID bid.
+func (r *Registry) Get(bid string) (DeviceEntry, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	e, ok := r.entries[bid]
+	return e, ok
+}
+
+// Devices returns the registered device entries in the order they were added.
+func (r *Registry) Devices() []DeviceEntry {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	devs := make([]DeviceEntry, 0, len(r.order))
+	for _, bid := range r.order {
+		devs = append(devs, r.entries[bid])
+	}
+	return devs
+}
@@ -0,0 +1,93 @@
+package mcumgrsvc
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateway.json")
+	cfg := `{"devices": [
+		{"bid": "board-01", "port": "/dev/ttyACM0"},
+		{"bid": "board-02", "port": "/dev/ttyACM1", "baud": 921600, "queue": "handover.board-02",
+		 "upload": {"image": 1, "noErase": true, "maxWinSz": 8}, "verify": false}
+	]}`
+	assert.Nil(t, os.WriteFile(path, []byte(cfg), 0644))
+
+	r, err := LoadRegistry(path)
+	assert.Nil(t, err)
+	devs := r.Devices()
+	assert.Equal(t, 2, len(devs))
+	assert.Equal(t, DeviceEntry{Bid: "board-01", Type: ConnTypeSerial, Port: "/dev/ttyACM0",
+		Baud: DefaultBaud, Mtu: DefaultMtu, Queue: "handover.board-01", Verify: true}, devs[0])
+	e, ok := r.Get("board-02")
+	assert.True(t, ok)
+	assert.Equal(t, 921600, e.Baud)
+	assert.Equal(t, "handover.board-02", e.Queue)
+	assert.Equal(t, UploadOptions{ImageNum: 1, NoErase: true, MaxWinSz: 8}, e.Upload)
+	assert.False(t, e.Verify)
+}
+
+func TestRegistryAdd(t *testing.T) {
+	r := NewRegistry()
+	assert.Nil(t, r.Add(DeviceEntry{Bid: "board-01", Port: "/dev/ttyACM0"}))
+	assert.Equal(t, ErrRegistryDuplicate, r.Add(DeviceEntry{Bid: "board-01", Port: "/dev/ttyACM1"}))
+	assert.Equal(t, ErrRegistryDuplicate, r.Add(DeviceEntry{Bid: "board-02", Port: "/dev/ttyACM0"}))
+	assert.Equal(t, ErrRegistryDevice, r.Add(DeviceEntry{Bid: "board-03"}))
+	_, ok := r.Get("board-03")
+	assert.False(t, ok)
+	assert.Equal(t, ErrRegistryDevice, r.Add(DeviceEntry{Bid: "board-04", Type: ConnTypeUdp}))
+	assert.Equal(t, ErrRegistryDevice, r.Add(DeviceEntry{Bid: "board-05", Type: "ble", Port: "/dev/ttyACM2"}))
+	assert.Nil(t, r.Add(DeviceEntry{Bid: "board-06", Type: ConnTypeUdp, Addr: "127.0.0.1:1337"}))
+	assert.Equal(t, ErrRegistryDuplicate,
+		r.Add(DeviceEntry{Bid: "board-07", Type: ConnTypeOicUdp, Addr: "127.0.0.1:1337"}))
+}
+
+func TestHandoverConfig(t *testing.T) {
+	e := DeviceEntry{Queue: "handover.board-01"}
+	assert.Equal(t, HandoverConfig{Queue: "handover.board-01"}, e.handoverConfig())
+
+	e.Handover = HandoverConfig{Exchange: "ports", Queue: "mcumgr.board-01", Durable: true}
+	assert.Equal(t, e.Handover, e.handoverConfig())
+
+	h, err := NewHandover("board-01", DeviceEntry{}.handoverConfig(), "")
+	assert.Nil(t, err)
+	assert.Equal(t, HandoverConfig{Type: HandoverAMQP, Queue: DefaultHandoverQueue,
+		RoutingKey: DefaultHandoverQueue, Owner: DefaultPortOwner}, h.(*amqpHandover).cfg)
+	assert.Equal(t, DefaultAMQPURL, h.(*amqpHandover).url)
+	assert.False(t, h.Health().Connected)
+
+	h, err = NewHandover("board-01", HandoverConfig{Type: HandoverMQTT, Queue: "mcumgr/board-01"}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "mcumgr/board-01", h.(*mqttHandover).cfg.RoutingKey)
+	assert.Equal(t, DefaultMQTTURL, h.(*mqttHandover).url)
+
+	// Boards sharing a queue still get a session each.
+	h2, err := NewHandover("board-02", HandoverConfig{Type: HandoverMQTT, Queue: "mcumgr/board-01"}, "ssl://broker:8883")
+	assert.Nil(t, err)
+	assert.Equal(t, "mcumgr-svc-board-01", h.(*mqttHandover).clientID)
+	assert.Equal(t, "mcumgr-svc-board-02", h2.(*mqttHandover).clientID)
+
+	_, err = NewHandover("board-01", HandoverConfig{Type: "zeromq"}, "")
+	assert.Equal(t, ErrHandoverType, err)
+	_, err = NewHandover("board-01", HandoverConfig{Type: HandoverMQTT}, DefaultAMQPURL)
+	assert.Equal(t, ErrHandoverURL, err)
+	_, err = NewHandover("board-01", HandoverConfig{}, DefaultMQTTURL)
+	assert.Equal(t, ErrHandoverURL, err)
+	_, err = NewHandover("board-01", HandoverConfig{Type: HandoverLocal}, DefaultMQTTURL)
+	assert.Nil(t, err)
+	_, err = NewHandover("board-01", HandoverConfig{Type: HandoverLocal, Peer: "slcan-svc"}, "")
+	assert.Equal(t, ErrHandoverPeer, err)
+	b := NewMCUMgrBackend(DeviceEntry{Bid: "board-01", Handover: HandoverConfig{Type: HandoverMQTT}}, DefaultAMQPURL)
+	assert.Equal(t, ErrHandoverURL, b.Run(context.Background()))
+	assert.Equal(t, ErrHandoverURL, b.HandoverHealth().Err)
+	r := NewRegistry()
+	assert.Equal(t, ErrRegistryDevice, r.Add(DeviceEntry{Bid: "board-01", Port: "/dev/ttyACM0",
+		Handover: HandoverConfig{Type: "zeromq"}}))
+	assert.Equal(t, ErrRegistryDevice, r.Add(DeviceEntry{Bid: "board-01", Port: "/dev/ttyACM0",
+		Handover: HandoverConfig{Type: HandoverLocal, Peer: "slcan-svc"}}))
+}
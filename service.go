@@ -2,14 +2,52 @@ package mcumgrsvc
 
 import (
 	"context"
+	"errors"
+	"io"
 
 	hawkbit "github.com/jonathanyhliang/hawkbit-fota/backend"
 )
 
+// ErrNotInstalled is returned by GetInstalledBase for an action which isn't
+// the one installed on the device.
+var ErrNotInstalled = errors.New("Service: action not installed")
+
+// DeploymentBaseFeedback is the feedback posted on a deployment action. On top
+// of hawkbit.DeploymentBaseFeedback it carries the status details and progress
+// of the DDI API, e.g. why an update failed or how far it got.
+type DeploymentBaseFeedback struct {
+	ID     string `json:"id"`
+	Status struct {
+		Execution string `json:"execution"`
+		Result    struct {
+			Finished string            `json:"finished"`
+			Progress *FeedbackProgress `json:"progress,omitempty"`
+		} `json:"result"`
+		Details []string `json:"details,omitempty"`
+	} `json:"status"`
+}
+
+// FeedbackProgress is the progress of a deployment action, Cnt out of Of.
+type FeedbackProgress struct {
+	Cnt int64 `json:"cnt"`
+	Of  int64 `json:"of"`
+}
+
+// CancelAction is Hawkbit's request to cancel the action StopID.
+type CancelAction struct {
+	ID           string `json:"id"`
+	CancelAction struct {
+		StopID string `json:"stopId"`
+	} `json:"cancelAction"`
+}
+
 type IService interface {
 	GetController(ctx context.Context, bid string) (hawkbit.Controller, error)
 	PutConfigData(ctx context.Context, bid string, cfg hawkbit.ConfigData) error
 	GetDeployBase(ctx context.Context, bid, acid string) (hawkbit.DeploymentBase, error)
-	PostDeployBaseFeedback(ctx context.Context, bid string, fb hawkbit.DeploymentBaseFeedback) error
-	GetDownloadHttp(ctx context.Context, bid, ver string) []byte
+	PostDeployBaseFeedback(ctx context.Context, bid string, fb DeploymentBaseFeedback) error
+	GetDownloadHttpStream(ctx context.Context, bid, ver string, off int64) (io.ReadCloser, int64, error)
+	GetInstalledBase(ctx context.Context, bid, acid string) (hawkbit.DeploymentBase, error)
+	GetCancelAction(ctx context.Context, bid, acid string) (CancelAction, error)
+	PostCancelActionFeedback(ctx context.Context, bid string, fb hawkbit.CancelActionFeedback) error
 }
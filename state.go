@@ -0,0 +1,180 @@
+package mcumgrsvc
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrStateTransition = errors.New("State: invalid transition")
+	ErrStateInvalid    = errors.New("State: invalid state")
+)
+
+// State is the phase an update of the device is in.
+type State int
+
+const (
+	// StateIdle is the state of a device no update was started for.
+	StateIdle State = iota
+	// StateDownloading is the state while the artifact is downloaded.
+	StateDownloading
+	// StateScheduled is the state of an image waiting for the port to be
+	// handed over before it is uploaded.
+	StateScheduled
+	// StateUploading is the state while the image is uploaded to the
+	// device.
+	StateUploading
+	// StateResetting is the state while the device is reset into the
+	// image, after marking it for test in swap mode.
+	StateResetting
+	// StateVerifying is the state while checking the device booted the
+	// image.
+	StateVerifying
+	// StateConfirming is the state while the image is made permanent in
+	// swap mode.
+	StateConfirming
+	// StateDone is the state of a completed update.
+	StateDone
+	// StateFailed is the state of a failed update.
+	StateFailed
+)
+
+var stateNames = map[State]string{
+	StateIdle:        "idle",
+	StateDownloading: "downloading",
+	StateScheduled:   "scheduled",
+	StateUploading:   "uploading",
+	StateResetting:   "resetting",
+	StateVerifying:   "verifying",
+	StateConfirming:  "confirming",
+	StateDone:        "done",
+	StateFailed:      "failed",
+}
+
+func (s State) String() string {
+	if n, ok := stateNames[s]; ok {
+		return n
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// MarshalText encodes s by name, e.g. for a Deployment recorded in a Store.
+func (s State) MarshalText() ([]byte, error) {
+	if _, ok := stateNames[s]; !ok {
+		return nil, fmt.Errorf("%w: %d", ErrStateInvalid, int(s))
+	}
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes a state encoded by MarshalText.
+func (s *State) UnmarshalText(b []byte) error {
+	for st, n := range stateNames {
+		if n == string(b) {
+			*s = st
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q", ErrStateInvalid, b)
+}
+
+// Terminal reports whether the update ended in s.
+func (s State) Terminal() bool {
+	return s == StateDone || s == StateFailed
+}
+
+// Hawkbit returns the execution and result values of the DDI API feedback
+// reporting s.
+func (s State) Hawkbit() (exec, result string) {
+	switch s {
+	case StateDownloading:
+		return "download", "none"
+	case StateScheduled:
+		return "scheduled", "none"
+	case StateUploading, StateResetting, StateVerifying, StateConfirming:
+		return "proceeding", "none"
+	case StateDone:
+		return "closed", "success"
+	case StateFailed:
+		return "closed", "failure"
+	}
+	return "closed", "none"
+}
+
+// stateTransitions lists the states each state may move to. A finished update
+// may be followed by a new one.
+var stateTransitions = map[State][]State{
+	StateIdle:        {StateDownloading, StateScheduled},
+	StateDownloading: {StateIdle, StateScheduled, StateFailed},
+	StateScheduled:   {StateUploading, StateFailed},
+	StateUploading:   {StateResetting, StateFailed},
+	StateResetting:   {StateVerifying, StateDone, StateFailed},
+	StateVerifying:   {StateConfirming, StateDone, StateFailed},
+	StateConfirming:  {StateDone, StateFailed},
+	StateDone:        {StateIdle, StateDownloading, StateScheduled},
+	StateFailed:      {StateIdle, StateDownloading, StateScheduled},
+}
+
+// Status is the state of an update, when it was entered, the state it was
+// entered from and, for StateFailed, why.
+type Status struct {
+	State State
+	Since time.Time
+	Prev  State
+	Err   error
+}
+
+// StateMachine tracks the state of the update of a device.
+type StateMachine struct {
+	mtx   sync.Mutex
+	cur   Status
+	watch hub[Status]
+}
+
+// NewStateMachine returns a StateMachine in StateIdle.
+func NewStateMachine() *StateMachine {
+	return &StateMachine{cur: Status{State: StateIdle, Since: time.Now()}}
+}
+
+// Status returns the current status.
+func (m *StateMachine) Status() Status {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.cur
+}
+
+// Transition moves to state to, recording cause as the error of the new
+// status. It fails with ErrStateTransition if to can't follow the current
+// state.
+func (m *StateMachine) Transition(to State, cause error) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if !m.allowed(to) {
+		return fmt.Errorf("%w: %s to %s", ErrStateTransition, m.cur.State, to)
+	}
+	m.cur = Status{State: to, Since: time.Now(), Prev: m.cur.State, Err: cause}
+	m.watch.publish(m.cur)
+	return nil
+}
+
+// Fail moves to StateFailed because of err.
+func (m *StateMachine) Fail(err error) error {
+	return m.Transition(StateFailed, err)
+}
+
+func (m *StateMachine) allowed(to State) bool {
+	for _, s := range stateTransitions[m.cur.State] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch returns a channel receiving every status change, and a function to
+// stop watching, which closes the channel. Changes are dropped while the
+// channel is full, so watchers should read Status once they catch up.
+func (m *StateMachine) Watch() (<-chan Status, func()) {
+	return m.watch.subscribe()
+}
@@ -0,0 +1,45 @@
+package mcumgrsvc
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateMachine(t *testing.T) {
+	m := NewStateMachine()
+	assert.Equal(t, StateIdle, m.Status().State)
+	changes, unwatch := m.Watch()
+
+	for _, s := range []State{StateDownloading, StateScheduled, StateUploading,
+		StateResetting, StateVerifying, StateConfirming, StateDone} {
+		assert.Nil(t, m.Transition(s, nil))
+		assert.Equal(t, s, (<-changes).State)
+	}
+	exec, result := m.Status().State.Hawkbit()
+	assert.Equal(t, "closed", exec)
+	assert.Equal(t, "success", result)
+
+	err := m.Transition(StateUploading, nil)
+	assert.True(t, errors.Is(err, ErrStateTransition))
+	assert.EqualError(t, err, "State: invalid transition: done to uploading")
+	assert.Equal(t, StateDone, m.Status().State)
+
+	assert.Nil(t, m.Transition(StateScheduled, nil))
+	assert.Nil(t, m.Fail(ErrBackendImage))
+	st := m.Status()
+	assert.Equal(t, StateFailed, st.State)
+	assert.Equal(t, ErrBackendImage, st.Err)
+	assert.Equal(t, StateScheduled, st.Prev)
+	assert.False(t, st.Since.IsZero())
+	exec, result = st.State.Hawkbit()
+	assert.Equal(t, "closed", exec)
+	assert.Equal(t, "failure", result)
+
+	unwatch()
+	assert.Equal(t, StateScheduled, (<-changes).State)
+	assert.Equal(t, StateFailed, (<-changes).State)
+	_, ok := <-changes
+	assert.False(t, ok)
+}
@@ -0,0 +1,137 @@
+package mcumgrsvc
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var ErrStoreDir = errors.New("Store: invalid state directory")
+
+// Deployment is what is recorded about the last deployment of a device, so it
+// can be resumed or reported after a restart.
+type Deployment struct {
+	// Acid is the ID of the Hawkbit action.
+	Acid string `json:"acid"`
+	// SHA256 is the hash of the artifact deployed.
+	SHA256 string `json:"sha256,omitempty"`
+	// State is the phase the update got to.
+	State State `json:"state"`
+	// Prev is the state State was entered from.
+	Prev State `json:"prev"`
+	// Err is why the update failed.
+	Err string `json:"err,omitempty"`
+	// Offset is the number of bytes of the image the device acknowledged.
+	Offset int64 `json:"offset,omitempty"`
+	// Reported is whether Hawkbit was told the update ended.
+	Reported bool `json:"reported,omitempty"`
+	// Since is when the deployment entered State.
+	Since time.Time `json:"since"`
+}
+
+// Interrupted reports whether the deployment was in flight when it was last
+// recorded.
+func (d Deployment) Interrupted() bool {
+	return d.Acid != "" && d.State != StateIdle && !d.State.Terminal()
+}
+
+// Status returns the status of the update the deployment recorded.
+func (d Deployment) Status() Status {
+	st := Status{State: d.State, Since: d.Since, Prev: d.Prev}
+	if d.Err != "" {
+		st.Err = errors.New(d.Err)
+	}
+	return st
+}
+
+// Store keeps the Deployment of each device in a JSON file of its own.
+type Store struct {
+	dir string
+	mtx sync.Mutex
+}
+
+// NewStore returns a Store keeping its files in dir, which is created if
+// needed.
+func NewStore(dir string) (*Store, error) {
+	if dir == "" {
+		return nil, ErrStoreDir
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+func (s *Store) path(bid string) string {
+	return filepath.Join(s.dir, url.PathEscape(bid)+".json")
+}
+
+// Load returns the deployment recorded for the device bid, or the zero
+// Deployment if there is none.
+func (s *Store) Load(bid string) (Deployment, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.load(bid)
+}
+
+func (s *Store) load(bid string) (Deployment, error) {
+	var d Deployment
+	b, err := os.ReadFile(s.path(bid))
+	if errors.Is(err, os.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return d, err
+	}
+	err = json.Unmarshal(b, &d)
+	return d, err
+}
+
+// Save records d as the deployment of the device bid.
+func (s *Store) Save(bid string, d Deployment) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.save(bid, d)
+}
+
+// Update records the deployment of the device bid as changed by fn.
+func (s *Store) Update(bid string, fn func(d *Deployment)) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	d, err := s.load(bid)
+	if err != nil {
+		return err
+	}
+	fn(&d)
+	return s.save(bid, d)
+}
+
+// save writes d to a temporary file first, so a crash never leaves a
+// truncated record behind.
+func (s *Store) save(bid string, d Deployment) error {
+	b, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path(bid))
+}
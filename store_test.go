@@ -0,0 +1,56 @@
+package mcumgrsvc
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	s, err := NewStore(t.TempDir())
+	assert.Nil(t, err)
+
+	d, err := s.Load("board/01")
+	assert.Nil(t, err)
+	assert.Equal(t, Deployment{}, d)
+	assert.False(t, d.Interrupted())
+
+	want := Deployment{
+		Acid:   "7",
+		SHA256: "ab",
+		State:  StateUploading,
+		Prev:   StateScheduled,
+		Offset: 4096,
+		Since:  time.Date(2023, 6, 18, 11, 36, 8, 0, time.UTC),
+	}
+	assert.Nil(t, s.Save("board/01", want))
+	d, err = s.Load("board/01")
+	assert.Nil(t, err)
+	assert.Equal(t, want, d)
+	assert.True(t, d.Interrupted())
+
+	assert.Nil(t, s.Update("board/01", func(d *Deployment) {
+		d.State, d.Prev, d.Err = StateFailed, StateUploading, "timeout"
+	}))
+	d, err = s.Load("board/01")
+	assert.Nil(t, err)
+	assert.False(t, d.Interrupted())
+	assert.Equal(t, "7", d.Acid)
+	assert.Equal(t, StateFailed, d.Status().State)
+	assert.EqualError(t, d.Status().Err, "timeout")
+
+	// States are recorded by name.
+	b, err := os.ReadFile(filepath.Join(s.dir, "board%2F01.json"))
+	assert.Nil(t, err)
+	var raw map[string]interface{}
+	assert.Nil(t, json.Unmarshal(b, &raw))
+	assert.Equal(t, "failed", raw["state"])
+
+	assert.Nil(t, os.WriteFile(s.path("bad"), []byte(`{"state":"bogus"}`), 0644))
+	_, err = s.Load("bad")
+	assert.ErrorIs(t, err, ErrStateInvalid)
+}
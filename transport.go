@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -25,6 +26,10 @@ import (
 	stdopentracing "github.com/opentracing/opentracing-go"
 )
 
+// responseHeaderTimeout is how long the client waits for the headers of a
+// response once its request is sent.
+const responseHeaderTimeout = 30 * time.Second
+
 // NewHTTPClient returns an AddService backed by an HTTP server living at the
 // remote instance. We expect instance to come from a service discovery system,
 // so likely of the form "host:port". We bake-in certain middlewares,
@@ -46,8 +51,14 @@ func NewHTTPClient(instance string, otTracer stdopentracing.Tracer, logger log.L
 	// for the entire remote instance, too.
 	limiter := ratelimit.NewErroringLimiter(rate.NewLimiter(rate.Every(time.Second), 100))
 
-	// global client middlewares
-	var options []httptransport.ClientOption
+	// global client middlewares. Connecting and waiting for the response
+	// headers are bounded, but not reading the body, as artifact downloads
+	// take as long as they take; Cache gives up on those going idle.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = responseHeaderTimeout
+	options := []httptransport.ClientOption{
+		httptransport.SetClient(&http.Client{Transport: transport}),
+	}
 
 	// Each individual endpoint is an http/transport.Client (which implements
 	// endpoint.Endpoint) that gets wrapped with various middlewares. If you
@@ -118,33 +129,88 @@ func NewHTTPClient(instance string, otTracer stdopentracing.Tracer, logger log.L
 			Timeout: 30 * time.Second,
 		}))(postDeployBaseFeedbackEndpoint)
 	}
-	var getDownloadHttpEndpoint endpoint.Endpoint
+	var getDownloadHttpStreamEndpoint endpoint.Endpoint
+	{
+		// The response body is handed to the caller instead of being read
+		// into memory, so keep it open.
+		getDownloadHttpStreamEndpoint = httptransport.NewClient(
+			"GET",
+			u,
+			encodeGetDownloadHttpStreamRequest,
+			decodeGetDownloadHttpStreamResponse,
+			append(options, httptransport.ClientBefore(opentracing.ContextToHTTP(otTracer, logger)),
+				httptransport.BufferedStream(true))...,
+		).Endpoint()
+		getDownloadHttpStreamEndpoint =
+			opentracing.TraceClient(otTracer, "GetDownloadHttpStream")(getDownloadHttpStreamEndpoint)
+		getDownloadHttpStreamEndpoint = limiter(getDownloadHttpStreamEndpoint)
+		getDownloadHttpStreamEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
+			Name:    "GetDownloadHttpStream",
+			Timeout: 30 * time.Second,
+		}))(getDownloadHttpStreamEndpoint)
+	}
+	var getInstalledBaseEndpoint endpoint.Endpoint
+	{
+		getInstalledBaseEndpoint = httptransport.NewClient(
+			"GET",
+			u,
+			encodeGetInstalledBaseRequest,
+			decodeGetInstalledBaseResponse,
+			append(options, httptransport.ClientBefore(opentracing.ContextToHTTP(otTracer, logger)))...,
+		).Endpoint()
+		getInstalledBaseEndpoint = opentracing.TraceClient(otTracer, "GetInstalledBase")(getInstalledBaseEndpoint)
+		getInstalledBaseEndpoint = limiter(getInstalledBaseEndpoint)
+		getInstalledBaseEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
+			Name:    "GetInstalledBase",
+			Timeout: 30 * time.Second,
+		}))(getInstalledBaseEndpoint)
+	}
+	var getCancelActionEndpoint endpoint.Endpoint
 	{
-		getDownloadHttpEndpoint = httptransport.NewClient(
+		getCancelActionEndpoint = httptransport.NewClient(
 			"GET",
 			u,
-			encodeGetDownloadHttpRequest,
-			decodeGetDownloadHttpResponse,
+			encodeGetCancelActionRequest,
+			decodeGetCancelActionResponse,
 			append(options, httptransport.ClientBefore(opentracing.ContextToHTTP(otTracer, logger)))...,
 		).Endpoint()
-		getDownloadHttpEndpoint =
-			opentracing.TraceClient(otTracer, "GetDownloadHttp")(getDownloadHttpEndpoint)
-		getDownloadHttpEndpoint = limiter(getDownloadHttpEndpoint)
-		getDownloadHttpEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
-			Name:    "GetDownloadHttp",
+		getCancelActionEndpoint = opentracing.TraceClient(otTracer, "GetCancelAction")(getCancelActionEndpoint)
+		getCancelActionEndpoint = limiter(getCancelActionEndpoint)
+		getCancelActionEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
+			Name:    "GetCancelAction",
 			Timeout: 30 * time.Second,
-		}))(getDownloadHttpEndpoint)
+		}))(getCancelActionEndpoint)
+	}
+	var postCancelActionFeedbackEndpoint endpoint.Endpoint
+	{
+		postCancelActionFeedbackEndpoint = httptransport.NewClient(
+			"POST",
+			u,
+			encodePostCancelActionFeedbackRequest,
+			decodePostCancelActionFeedbackResponse,
+			append(options, httptransport.ClientBefore(opentracing.ContextToHTTP(otTracer, logger)))...,
+		).Endpoint()
+		postCancelActionFeedbackEndpoint =
+			opentracing.TraceClient(otTracer, "PostCancelActionFeedback")(postCancelActionFeedbackEndpoint)
+		postCancelActionFeedbackEndpoint = limiter(postCancelActionFeedbackEndpoint)
+		postCancelActionFeedbackEndpoint = circuitbreaker.Gobreaker(gobreaker.NewCircuitBreaker(gobreaker.Settings{
+			Name:    "PostCancelActionFeedback",
+			Timeout: 30 * time.Second,
+		}))(postCancelActionFeedbackEndpoint)
 	}
 
 	// Returning the endpoint.Set as a Service relies on the
 	// Endpoints implementing the Service methods. That's just a simple bit
 	// of glue code.
 	return Endpoints{
-		GetControllerEndpoint:          getControllerEndpoint,
-		PutConfigDataEndpoint:          putConfigDataEndpoint,
-		GetDeployBaseEndpoint:          getDeployBaseEndpoint,
-		PostDeployBaseFeedbackEndpoint: postDeployBaseFeedbackEndpoint,
-		GetDownloadHttpEndpoint:        getDownloadHttpEndpoint,
+		GetControllerEndpoint:            getControllerEndpoint,
+		PutConfigDataEndpoint:            putConfigDataEndpoint,
+		GetDeployBaseEndpoint:            getDeployBaseEndpoint,
+		PostDeployBaseFeedbackEndpoint:   postDeployBaseFeedbackEndpoint,
+		GetDownloadHttpStreamEndpoint:    getDownloadHttpStreamEndpoint,
+		GetInstalledBaseEndpoint:         getInstalledBaseEndpoint,
+		GetCancelActionEndpoint:          getCancelActionEndpoint,
+		PostCancelActionFeedbackEndpoint: postCancelActionFeedbackEndpoint,
 	}, nil
 }
 
@@ -181,20 +247,52 @@ func encodeGetDeployBaseRequest(ctx context.Context, req *http.Request, request
 
 func encodePostDeployBaseFeedbackRequest(ctx context.Context, req *http.Request, request interface{}) error {
 	// r.Methods("POST").Path("/default/controller/v1/{bid}/deploymentBase/{acid}/feedback")
-	r := request.(hawkbit.PostDeploymentBaseFeedbackRequest)
+	r := request.(PostDeployBaseFeedbackRequest)
 	bid := url.QueryEscape(r.Bid)
 	acid := url.QueryEscape(r.Fb.ID)
 	req.URL.Path = "/default/controller/v1/" + bid + "/deploymentBase/" + acid + "/feedback"
-	return encodeRequest(ctx, req, request)
+	// The feedback itself is the body the DDI API expects.
+	return encodeRequest(ctx, req, r.Fb)
 }
 
-func encodeGetDownloadHttpRequest(ctx context.Context, req *http.Request, request interface{}) error {
+func encodeGetDownloadHttpStreamRequest(ctx context.Context, req *http.Request, request interface{}) error {
 	// r.Methods("GET").Path("/DEFAULT/controller/v1/{bid}/softwareModules/{ver}")
-	r := request.(hawkbit.GetDownloadHttpRequest)
+	r := request.(GetDownloadHttpStreamRequest)
 	bid := url.QueryEscape(r.Bid)
 	ver := url.QueryEscape(r.Ver)
 	req.URL.Path = "/DEFAULT/controller/v1/" + bid + "/softwareModules/" + ver
-	return encodeRequest(ctx, req, request)
+	// Resume an interrupted download where it stopped.
+	if r.Off > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.Off))
+	}
+	return nil
+}
+
+func encodeGetInstalledBaseRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("GET").Path("/default/controller/v1/{bid}/installedBase/{acid}")
+	r := request.(GetInstalledBaseRequest)
+	bid := url.QueryEscape(r.Bid)
+	acid := url.QueryEscape(r.Acid)
+	req.URL.Path = "/default/controller/v1/" + bid + "/installedBase/" + acid
+	return nil
+}
+
+func encodeGetCancelActionRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("GET").Path("/default/controller/v1/{bid}/cancelAction/{acid}")
+	r := request.(GetCancelActionRequest)
+	bid := url.QueryEscape(r.Bid)
+	acid := url.QueryEscape(r.Acid)
+	req.URL.Path = "/default/controller/v1/" + bid + "/cancelAction/" + acid
+	return nil
+}
+
+func encodePostCancelActionFeedbackRequest(ctx context.Context, req *http.Request, request interface{}) error {
+	// r.Methods("POST").Path("/default/controller/v1/{bid}/cancelAction/{acid}/feedback")
+	r := request.(hawkbit.PostCancelActionFeedbackRequest)
+	bid := url.QueryEscape(r.Bid)
+	acid := url.QueryEscape(r.Fb.ID)
+	req.URL.Path = "/default/controller/v1/" + bid + "/cancelAction/" + acid + "/feedback"
+	return encodeRequest(ctx, req, r.Fb)
 }
 
 // encodeRequest likewise JSON-encodes the request to the HTTP request body.
@@ -251,15 +349,53 @@ func decodePostDeployBaseFeebackResponse(_ context.Context, r *http.Response) (i
 	return resp, err
 }
 
-func decodeGetDownloadHttpResponse(_ context.Context, r *http.Response) (interface{}, error) {
+func decodeGetDownloadHttpStreamResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	switch r.StatusCode {
+	case http.StatusOK:
+		// The server sent the whole artifact, whatever range was asked for.
+		return GetDownloadHttpStreamResponse{Body: r.Body}, nil
+	case http.StatusPartialContent:
+		// Content-Range: bytes <first>-<last>/<size>
+		var first, last int64
+		_, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/", &first, &last)
+		if err != nil {
+			r.Body.Close()
+			return nil, errors.New("invalid Content-Range")
+		}
+		return GetDownloadHttpStreamResponse{Body: r.Body, Off: first}, nil
+	}
+	r.Body.Close()
+	return nil, errors.New(r.Status)
+}
+
+func decodeGetInstalledBaseResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	// An action which isn't installed is an answer, not a failure of the
+	// server, so keep it off the circuit breaker.
+	if r.StatusCode == http.StatusNotFound {
+		return GetInstalledBaseResponse{Err: ErrNotInstalled}, nil
+	}
 	if r.StatusCode != http.StatusOK {
 		return nil, errors.New(r.Status)
 	}
-	var resp hawkbit.GetDownloadHttpResponse
-	var err error
-	resp.File, err = ioutil.ReadAll(r.Body)
-	if err != nil {
-		return nil, err
+	var resp GetInstalledBaseResponse
+	err := json.NewDecoder(r.Body).Decode(&resp.Ib)
+	return resp, err
+}
+
+func decodeGetCancelActionResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return nil, errors.New(r.Status)
 	}
+	var resp GetCancelActionResponse
+	err := json.NewDecoder(r.Body).Decode(&resp.Ca)
+	return resp, err
+}
+
+func decodePostCancelActionFeedbackResponse(_ context.Context, r *http.Response) (interface{}, error) {
+	if r.StatusCode != http.StatusOK {
+		return nil, errors.New(r.Status)
+	}
+	var resp hawkbit.PostCancelActionFeedbackResponse
+	err := json.NewDecoder(r.Body).Decode(&resp)
 	return resp, err
 }